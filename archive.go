@@ -0,0 +1,439 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	RegisterBackend("archive", archiveBackend{})
+}
+
+type ArchiveDependency struct {
+	VCS             string `json:"vcs"` // XXX it doesn't make sense from a data model point of view to have this field. It's to help converting to JSON.
+	URL             string `json:"url"`
+	SHA256          string `json:"sha256"`
+	StripComponents int    `json:"strip_components,omitempty"`
+	Format          string `json:"format,omitempty"`
+	Dir             string `json:"dir,omitempty"`
+	Hash            string `json:"hash,omitempty"`
+	CommonKeys
+}
+
+func (d ArchiveDependency) Kind() string        { return "archive" }
+func (d ArchiveDependency) IgnoreDir() string   { return "" } // Nothing to ignore.
+func (d ArchiveDependency) DirToCopy() string   { return d.Dir }
+func (d ArchiveDependency) Revision() string    { return d.SHA256 }
+func (d ArchiveDependency) Immutable() bool     { return true } // Checked against its sha256.
+func (d ArchiveDependency) ContentHash() string { return d.Hash }
+func (d ArchiveDependency) Host() string        { return urlHost(d.URL) }
+func (d ArchiveDependency) Source() string      { return d.URL }
+func (d ArchiveDependency) SameSource(other Dependency) bool {
+	o, ok := other.(ArchiveDependency)
+	return ok && o.URL == d.URL && o.Dir == d.Dir && o.StripComponents == d.StripComponents && o.Format == d.Format
+}
+func (d ArchiveDependency) WithContentHash(hash string) Dependency {
+	d.Hash = hash
+	return d
+}
+func (d ArchiveDependency) WithCommon(common CommonKeys) Dependency {
+	d.CommonKeys = common
+	return d
+}
+func (d ArchiveDependency) WithDir(dir string) Dependency {
+	d.Dir = dir
+	return d
+}
+
+func LoadArchiveDependency(depMap map[string]string) (ArchiveDependency, error) {
+	d := ArchiveDependency{VCS: "archive"}
+	var ok bool
+	if d.URL, ok = depMap["url"]; !ok {
+		return ArchiveDependency{}, errors.New("missing required key 'url'")
+	}
+	if d.SHA256, ok = depMap["sha256"]; !ok {
+		return ArchiveDependency{}, errors.New("missing required key 'sha256'")
+	}
+	d.SHA256 = strings.ToLower(d.SHA256)
+	if len(d.SHA256) != sha256.Size*2 || strings.Trim(d.SHA256, "0123456789abcdef") != "" {
+		return ArchiveDependency{}, fmt.Errorf("invalid value %q for key 'sha256'", d.SHA256)
+	}
+	if strip, ok := depMap["strip_components"]; ok {
+		var err error
+		if d.StripComponents, err = strconv.Atoi(strip); err != nil || d.StripComponents < 0 {
+			return ArchiveDependency{}, fmt.Errorf("invalid value %q for key 'strip_components'", strip)
+		}
+	}
+	d.Format = depMap["format"]
+	if _, err := ArchiveFormat(d); err != nil {
+		return ArchiveDependency{}, err
+	}
+	d.Dir = depMap["dir"]
+	if err := checkDir(d.Dir); err != nil {
+		return ArchiveDependency{}, err
+	}
+	d.Hash = depMap["hash"]
+	delete(depMap, "vcs")
+	delete(depMap, "url")
+	delete(depMap, "sha256")
+	delete(depMap, "strip_components")
+	delete(depMap, "format")
+	delete(depMap, "dir")
+	delete(depMap, "hash")
+	for k, v := range depMap {
+		LogWarn(`Ignoring unknown key value pair %q:%q`, k, v)
+	}
+	return d, nil
+}
+
+type archiveBackend struct{}
+
+func (archiveBackend) Load(ctx context.Context, depMap map[string]string) (Dependency, error) {
+	return LoadArchiveDependency(depMap)
+}
+
+func (archiveBackend) Stage(ctx context.Context, dep Dependency, stagingDir string) (Dependency, error) {
+	archiveDep := dep.(ArchiveDependency)
+
+	format, err := ArchiveFormat(archiveDep)
+	if err != nil {
+		return nil, err
+	}
+
+	// Download the archive, checking it's the one we expect.
+	archive, err := ioutil.TempFile("", "courier_archive_")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(archive.Name()) // If this errors out, there's not much we can do.
+	sum, err := DownloadFile(ctx, archive, archiveDep.URL)
+	if closeErr := archive.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, stepError("download", err)
+	}
+	if sum != archiveDep.SHA256 {
+		return nil, stepError("checksum", fmt.Errorf("checksum mismatch for %q: expected sha256 %s, got %s", archiveDep.URL, archiveDep.SHA256, sum))
+	}
+
+	// Extract it.
+	if err := ExtractArchive(ctx, stagingDir, archive.Name(), format, archiveDep.StripComponents); err != nil {
+		return nil, stepError("extract", err)
+	}
+
+	return archiveDep, nil
+}
+
+func (archiveBackend) Resolve(ctx context.Context, dep Dependency) (string, error) {
+	return dep.(ArchiveDependency).SHA256, nil
+}
+
+// archiveExtensions maps file extensions to the archive formats they denote.
+var archiveExtensions = []struct{ ext, format string }{
+	{".tar.gz", "tar.gz"},
+	{".tgz", "tar.gz"},
+	{".tar.bz2", "tar.bz2"},
+	{".tbz2", "tar.bz2"},
+	{".tar.xz", "tar.xz"},
+	{".txz", "tar.xz"},
+	{".tar", "tar"},
+	{".zip", "zip"},
+}
+
+// ArchiveFormat returns the format of the archive dep refers to, either as
+// given explicitly or as determined from the extension of its URL.
+func ArchiveFormat(dep ArchiveDependency) (string, error) {
+	if dep.Format != "" {
+		for _, e := range archiveExtensions {
+			if e.format == dep.Format {
+				return dep.Format, nil
+			}
+		}
+		return "", fmt.Errorf("unknown archive format %q", dep.Format)
+	}
+	p := dep.URL
+	if u, err := url.Parse(dep.URL); err == nil {
+		p = u.Path
+	}
+	for _, e := range archiveExtensions {
+		if strings.HasSuffix(strings.ToLower(p), e.ext) {
+			return e.format, nil
+		}
+	}
+	return "", fmt.Errorf("cannot determine archive format of %q, add a 'format' key", dep.URL)
+}
+
+// DownloadFile writes the contents of rawurl, which may be an http, https or
+// file URL, to w. It returns the hex encoded SHA-256 hash of the contents.
+func DownloadFile(ctx context.Context, w io.Writer, rawurl string) (string, error) {
+	LogDebug(`Downloading %q`, rawurl)
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+
+	var body io.ReadCloser
+	switch u.Scheme {
+	case "http", "https":
+		req, err := http.NewRequest("GET", rawurl, nil)
+		if err != nil {
+			return "", err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return "", fmt.Errorf("downloading %q: %s", rawurl, resp.Status)
+		}
+		body = resp.Body
+	case "file":
+		p := filepath.FromSlash(u.Path)
+		if len(u.Path) > 2 && u.Path[0] == '/' && u.Path[2] == ':' {
+			p = filepath.FromSlash(u.Path[1:]) // e.g. file:///C:/archive.zip
+		}
+		if body, err = os.Open(p); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unsupported URL scheme %q in %q", u.Scheme, rawurl)
+	}
+	defer body.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, hash), body); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// ExtractArchive extracts the archive file, which is in the given format, into
+// dir. The first strip components of each path in the archive are removed, and
+// anything not under that many directories is skipped.
+func ExtractArchive(ctx context.Context, dir, file, format string, strip int) error {
+	LogDebug(`Extracting %s archive %q to %q`, format, file, dir)
+
+	x := extractor{dir: dir, strip: strip}
+
+	if format == "zip" {
+		r, err := zip.OpenReader(file)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			if err := x.extractZipFile(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	fp, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	var r io.Reader
+	switch format {
+	case "tar":
+		r = fp
+	case "tar.gz":
+		gz, err := gzip.NewReader(fp)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case "tar.bz2":
+		r = bzip2.NewReader(fp)
+	case "tar.xz":
+		// There's no xz support in the standard library.
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		cmd := exec.Command("xz", "--decompress", "--stdout")
+		cmd.Stdin = fp
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		wait, err := StartCommand(ctx, cmd)
+		if err != nil {
+			return fmt.Errorf("cannot run xz to extract %q: %v", file, err)
+		}
+		err = x.extractTar(stdout)
+		if err != nil {
+			cancel() // Stop xz, which may be blocked writing what wasn't read.
+		}
+		if waitErr := wait(); err == nil && waitErr != nil {
+			err = fmt.Errorf("xz: %v", waitErr)
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown archive format %q", format)
+	}
+	return x.extractTar(r)
+}
+
+type extractor struct {
+	dir   string
+	strip int
+}
+
+func (x extractor) extractTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = x.mkdir(hdr.Name)
+		case tar.TypeReg, tar.TypeRegA:
+			err = x.writeFile(hdr.Name, os.FileMode(hdr.Mode).Perm(), tr)
+		case tar.TypeSymlink:
+			err = x.symlink(hdr.Name, hdr.Linkname)
+		case tar.TypeLink:
+			err = x.link(hdr.Name, hdr.Linkname)
+		default:
+			LogDebug(`Skipping %q of tar type %q`, hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (x extractor) extractZipFile(f *zip.File) error {
+	mode := f.Mode()
+	if mode.IsDir() {
+		return x.mkdir(f.Name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if mode&os.ModeSymlink != 0 {
+		target, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return err
+		}
+		return x.symlink(f.Name, string(target))
+	}
+	return x.writeFile(f.Name, mode.Perm(), rc)
+}
+
+// target returns the path name should be extracted to, or "" if it should be
+// skipped.
+func (x extractor) target(name string) (string, error) {
+	p := path.Clean(strings.Replace(name, `\`, "/", -1))
+	if path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("archive contains unsafe path %q", name)
+	}
+	parts := strings.Split(p, "/")
+	if p == "." || len(parts) <= x.strip {
+		return "", nil
+	}
+	// Don't go through links extracted earlier, which could be chained to
+	// point outside of what's extracted.
+	dst := x.dir
+	for _, part := range parts[x.strip:] {
+		dst = filepath.Join(dst, part)
+		fi, err := os.Lstat(dst)
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("archive contains path %q through link", name)
+		}
+	}
+	return filepath.Join(x.dir, filepath.FromSlash(path.Join(parts[x.strip:]...))), nil
+}
+
+func (x extractor) mkdir(name string) error {
+	dst, err := x.target(name)
+	if err != nil || dst == "" {
+		return err
+	}
+	return os.MkdirAll(dst, 0755)
+}
+
+func (x extractor) writeFile(name string, perm os.FileMode, r io.Reader) error {
+	dst, err := x.target(name)
+	if err != nil || dst == "" {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	fp, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm|0600)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	_, err = io.Copy(fp, r)
+	return err
+}
+
+func (x extractor) symlink(name, target string) error {
+	dst, err := x.target(name)
+	if err != nil || dst == "" {
+		return err
+	}
+	// Don't allow links to point outside of what's extracted.
+	rel, _ := filepath.Rel(x.dir, dst)
+	resolved := path.Join(path.Dir(filepath.ToSlash(rel)), target)
+	if path.IsAbs(target) || resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return fmt.Errorf("archive contains unsafe link %q to %q", name, target)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return os.Symlink(target, dst)
+}
+
+func (x extractor) link(name, target string) error {
+	src, err := x.target(target)
+	if err != nil {
+		return err
+	}
+	if src == "" {
+		return fmt.Errorf("archive contains link %q to skipped file %q", name, target)
+	}
+	fp, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	return x.writeFile(name, fi.Mode().Perm(), fp)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var archiveTestFiles = []struct{ name, contents string }{
+	{"lib-1.0/include/lib.h", "header"},
+	{"lib-1.0/src/lib.c", "source"},
+}
+
+func makeTar(t *testing.T, files []struct{ name, contents string }) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.contents)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeTarGz(t *testing.T, files []struct{ name, contents string }) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(makeTar(t, files)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeZip(t *testing.T, files []struct{ name, contents string }) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(f.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// compressWith compresses buf with an external tool, returning nil if the tool
+// isn't available.
+func compressWith(t *testing.T, tool string, buf []byte) []byte {
+	if _, err := exec.LookPath(tool); err != nil {
+		t.Logf("%s not found on PATH; skipping", tool)
+		return nil
+	}
+	cmd := exec.Command(tool, "--stdout")
+	cmd.Stdin = bytes.NewReader(buf)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("%s: %v", tool, err)
+	}
+	return out
+}
+
+func checkStagedArchive(t *testing.T, staged StagedDependency, sum string) {
+	if pin := staged.Pinned.(ArchiveDependency).SHA256; pin != sum {
+		t.Errorf("StageDependency: pinned sha256 %q, expected %q", pin, sum)
+	}
+	p := filepath.Join(staged.StagingDir, "include", "lib.h")
+	if buf, err := ioutil.ReadFile(p); err != nil || string(buf) != "header" {
+		t.Errorf("StageDependency: include/lib.h = %q, %v; expected %q", buf, err, "header")
+	}
+}
+
+func TestStageArchiveDependencyHTTP(t *testing.T) {
+	archive := makeTarGz(t, archiveTestFiles)
+	sum := fmt.Sprintf("%x", sha256.Sum256(archive))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/lib-1.0.tar.gz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(archive)
+	}))
+	defer server.Close()
+
+	dep := ArchiveDependency{VCS: "archive", URL: server.URL + "/lib-1.0.tar.gz", SHA256: sum, StripComponents: 1}
+	staged, err := StageDependency(context.Background(), dep)
+	if err != nil {
+		t.Fatalf("StageDependency: %v", err)
+	}
+	defer os.RemoveAll(staged.StagingDir)
+	checkStagedArchive(t, staged, sum)
+
+	dep.SHA256 = fmt.Sprintf("%x", sha256.Sum256([]byte("something else")))
+	if _, err := StageDependency(context.Background(), dep); err == nil {
+		t.Errorf("StageDependency: expected error on checksum mismatch")
+	}
+	dep.URL = server.URL + "/missing.tar.gz"
+	if _, err := StageDependency(context.Background(), dep); err == nil {
+		t.Errorf("StageDependency: expected error on missing archive")
+	}
+}
+
+func TestStageArchiveDependencyFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "courier_test_archives_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archives := map[string]func() []byte{
+		"lib.tar":     func() []byte { return makeTar(t, archiveTestFiles) },
+		"lib.tgz":     func() []byte { return makeTarGz(t, archiveTestFiles) },
+		"lib.zip":     func() []byte { return makeZip(t, archiveTestFiles) },
+		"lib.tar.bz2": func() []byte { return compressWith(t, "bzip2", makeTar(t, archiveTestFiles)) },
+		"lib.tar.xz":  func() []byte { return compressWith(t, "xz", makeTar(t, archiveTestFiles)) },
+	}
+	for name, makeArchive := range archives {
+		archive := makeArchive()
+		if archive == nil {
+			continue
+		}
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, archive, 0644); err != nil {
+			t.Fatal(err)
+		}
+		sum := fmt.Sprintf("%x", sha256.Sum256(archive))
+		dep := ArchiveDependency{VCS: "archive", URL: "file://" + filepath.ToSlash(p), SHA256: sum, StripComponents: 1, Dir: "include"}
+		staged, err := StageDependency(context.Background(), dep)
+		if err != nil {
+			t.Errorf("StageDependency: %s: %v", name, err)
+			continue
+		}
+		checkStagedArchive(t, staged, sum)
+		os.RemoveAll(staged.StagingDir)
+	}
+}
+
+func TestExtractArchiveUnsafePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "courier_test_archives_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"../evil", "lib/../../evil", "/etc/evil"} {
+		p := filepath.Join(dir, "evil.tar")
+		if err := ioutil.WriteFile(p, makeTar(t, []struct{ name, contents string }{{name, "evil"}}), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ExtractArchive(context.Background(), filepath.Join(dir, "out"), p, "tar", 0); err == nil {
+			t.Errorf("ExtractArchive: %q: expected error for unsafe path", name)
+		}
+	}
+
+	// Links that each stay inside, but chained point outside.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "x", Linkname: ".", Typeflag: tar.TypeSymlink},
+		{Name: "y", Linkname: "x/..", Typeflag: tar.TypeSymlink},
+		{Name: "y/evil", Mode: 0644, Size: 4, Typeflag: tar.TypeReg},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tw.Write([]byte("evil")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "links.tar")
+	if err := ioutil.WriteFile(p, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExtractArchive(context.Background(), filepath.Join(dir, "out"), p, "tar", 0); err == nil {
+		t.Errorf("ExtractArchive: expected error for path through chained links")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "evil")); !os.IsNotExist(err) {
+		t.Errorf("ExtractArchive: file written outside of the extracted dir")
+	}
+}
+
+func TestLoadArchiveDependency(t *testing.T) {
+	sum := strings.Repeat("ab", sha256.Size)
+	m, err := LoadManifest(context.Background(), []byte(`{"lib": {"vcs": "archive", "url": "https://example.com/lib-1.0.tar.gz", "sha256": "`+strings.ToUpper(sum)+`", "strip_components": 1}}`))
+	if err != nil {
+		t.Fatalf("LoadManifest: %v", err)
+	}
+	expected := ArchiveDependency{VCS: "archive", URL: "https://example.com/lib-1.0.tar.gz", SHA256: sum, StripComponents: 1}
+	if !reflect.DeepEqual(m["lib"], expected) {
+		t.Errorf("LoadManifest: got %v, expected %v", m["lib"], expected)
+	}
+	for _, js := range []string{
+		`{"lib": {"vcs": "archive", "url": "https://example.com/lib-1.0.rar", "sha256": "` + sum + `"}}`,
+		`{"lib": {"vcs": "archive", "url": "https://example.com/lib.tgz", "sha256": "` + sum + `", "strip_components": -1}}`,
+		`{"lib": {"vcs": "archive", "url": "https://example.com/lib.tgz", "sha256": "` + sum + `", "strip_components": [1]}}`,
+		`{"lib": {"vcs": "archive", "url": "https://example.com/lib.tgz"}}`,
+		`{"lib": {"vcs": "archive", "url": "https://example.com/lib.tgz", "sha256": "abc"}}`,
+		`{"lib": {"vcs": "archive", "url": "https://example.com/lib.tgz", "sha256": "` + sum + `", "dir": "../.."}}`,
+		`{"lib": {"vcs": "archive", "url": "https://example.com/lib.tgz", "sha256": "` + sum + `", "dir": "/src"}}`,
+	} {
+		if _, err := LoadManifest(context.Background(), []byte(js)); err == nil {
+			t.Errorf("LoadManifest: %s: expected error", js)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// Backend obtains one kind of dependency. Each backend is registered under the
+// value of the "vcs" key of the dependencies it obtains, normally from the
+// init function of the file implementing it.
+type Backend interface {
+	// Load parses and validates a dependency from the keys of its manifest
+	// entry.
+	Load(ctx context.Context, depMap map[string]string) (Dependency, error)
+
+	// Stage obtains dep into stagingDir, which is an empty directory, and
+	// returns the dependency pinned to exactly what was obtained.
+	Stage(ctx context.Context, dep Dependency, stagingDir string) (Dependency, error)
+
+	// Resolve returns the revision dep would be pinned to if it were staged
+	// now.
+	Resolve(ctx context.Context, dep Dependency) (string, error)
+}
+
+var backends = make(map[string]Backend)
+
+// RegisterBackend makes a backend available for dependencies with the given
+// value of "vcs".
+func RegisterBackend(vcs string, backend Backend) {
+	if _, dup := backends[vcs]; dup {
+		panic(fmt.Sprintf("backend %q registered twice", vcs))
+	}
+	backends[vcs] = backend
+}
+
+// LookupBackend returns the backend registered for vcs, or failing that, the
+// plugin for it on PATH.
+func LookupBackend(vcs string) (Backend, error) {
+	backend, ok := backends[vcs]
+	if !ok {
+		backend, ok = LookupPlugin(vcs)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown dependency vcs '%s'", vcs)
+	}
+	return backend, nil
+}
+
+// BackendNames returns the values of "vcs" that have a backend registered.
+func BackendNames() []string {
+	var names []string
+	for vcs := range backends {
+		names = append(names, vcs)
+	}
+	sort.Strings(names)
+	return names
+}
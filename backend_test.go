@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type fakeDependency struct {
+	VCS      string `json:"vcs"`
+	Contents string `json:"contents"`
+	Hash     string `json:"hash,omitempty"`
+	CommonKeys
+}
+
+func (d fakeDependency) Kind() string        { return "fake" }
+func (d fakeDependency) IgnoreDir() string   { return "" }
+func (d fakeDependency) DirToCopy() string   { return "" }
+func (d fakeDependency) Revision() string    { return d.Contents }
+func (d fakeDependency) Immutable() bool     { return true }
+func (d fakeDependency) ContentHash() string { return d.Hash }
+func (d fakeDependency) SameSource(other Dependency) bool {
+	_, ok := other.(fakeDependency)
+	return ok
+}
+func (d fakeDependency) WithContentHash(hash string) Dependency {
+	d.Hash = hash
+	return d
+}
+func (d fakeDependency) WithCommon(common CommonKeys) Dependency {
+	d.CommonKeys = common
+	return d
+}
+
+type fakeBackend struct{}
+
+func (fakeBackend) Load(ctx context.Context, depMap map[string]string) (Dependency, error) {
+	contents, ok := depMap["contents"]
+	if !ok {
+		return nil, errors.New("missing required key 'contents'")
+	}
+	return fakeDependency{VCS: "fake", Contents: contents}, nil
+}
+
+func (fakeBackend) Stage(ctx context.Context, dep Dependency, stagingDir string) (Dependency, error) {
+	d := dep.(fakeDependency)
+	return d, ioutil.WriteFile(filepath.Join(stagingDir, "file"), []byte(d.Contents), 0644)
+}
+
+func (fakeBackend) Resolve(ctx context.Context, dep Dependency) (string, error) {
+	return dep.Revision(), nil
+}
+
+func TestRegisterBackend(t *testing.T) {
+	RegisterBackend("fake", fakeBackend{})
+	defer delete(backends, "fake")
+
+	m, err := LoadManifest(context.Background(), []byte(`{"dep": {"vcs": "fake", "contents": "hello"}}`))
+	if err != nil {
+		t.Fatalf("LoadManifest: %v", err)
+	}
+	stagedDeps, err := StageDependencies(context.Background(), m)
+	if err != nil {
+		t.Fatalf("StageDependencies: %v", err)
+	}
+	staged := stagedDeps["dep"]
+	defer os.RemoveAll(staged.StagingDir)
+	if buf, err := ioutil.ReadFile(filepath.Join(staged.StagingDir, "file")); err != nil || string(buf) != "hello" {
+		t.Errorf("StageDependencies: file = %q, %v; expected %q", buf, err, "hello")
+	}
+	if staged.Pinned.ContentHash() == "" {
+		t.Errorf("StageDependencies: expected pin to have a content hash")
+	}
+
+	if _, err := LoadManifest(context.Background(), []byte(`{"dep": {"vcs": "unknown"}}`)); err == nil {
+		t.Errorf("LoadManifest: expected error for unknown vcs")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// gitCache is the mirror cache used when staging Git dependencies. It is nil
+// when caching is disabled.
+var gitCache *GitCache
+
+// GitCache is a directory of bare mirrors of Git repositories, keyed by URL.
+// Staging clones from a mirror after fetching into it, so repeated runs only
+// download what has changed upstream.
+type GitCache struct {
+	Root string
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func NewGitCache(root string) *GitCache {
+	return &GitCache{Root: root, locks: make(map[string]*sync.Mutex)}
+}
+
+// DefaultCacheDir returns $XDG_CACHE_HOME/courier, falling back to the
+// platform's usual per-user cache location. It returns "" if no suitable
+// location can be found.
+func DefaultCacheDir() string {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "courier")
+	}
+	switch {
+	case os.Getenv("LOCALAPPDATA") != "":
+		return filepath.Join(os.Getenv("LOCALAPPDATA"), "courier")
+	case os.Getenv("HOME") != "":
+		return filepath.Join(os.Getenv("HOME"), ".cache", "courier")
+	}
+	return ""
+}
+
+// MirrorDir returns the directory holding the mirror for url.
+func (c *GitCache) MirrorDir(url string) string {
+	name := strings.TrimSuffix(path.Base(strings.Replace(url, `\`, "/", -1)), ".git")
+	return filepath.Join(c.Root, "git", fmt.Sprintf("%x-%s.git", sha1.Sum([]byte(url)), name))
+}
+
+// Has reports whether a mirror for url already exists.
+func (c *GitCache) Has(url string) bool {
+	fi, err := os.Stat(c.MirrorDir(url))
+	return err == nil && fi.IsDir()
+}
+
+// Update creates the mirror for url, or fetches into it if it already exists,
+// and returns its directory.
+func (c *GitCache) Update(ctx context.Context, url string) (string, error) {
+
+	// Dependencies sharing a URL share a mirror, so don't let them fetch into
+	// it at the same time.
+	lock := c.lock(url)
+	lock.Lock()
+	defer lock.Unlock()
+
+	mirror := c.MirrorDir(url)
+	if c.Has(url) {
+		LogDebug(`Updating cached mirror %q of %q`, mirror, url)
+		return mirror, GitFetchMirror(ctx, mirror)
+	}
+
+	// Clone next to where the mirror will live and move it into place once
+	// complete, so that an interrupted clone doesn't leave a broken mirror.
+	LogDebug(`Creating cached mirror %q of %q`, mirror, url)
+	if err := os.MkdirAll(filepath.Dir(mirror), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(mirror), ".tmp_")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp) // If this errors out, there's not much we can do.
+	if err := GitCloneMirror(ctx, tmp, url); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, mirror); err != nil {
+		return "", err
+	}
+	return mirror, nil
+}
+
+// Clone clones url into dir by way of its cached mirror.
+func (c *GitCache) Clone(ctx context.Context, dir, url string) error {
+	mirror, err := c.Update(ctx, url)
+	if err != nil {
+		return err
+	}
+	return GitClone(ctx, dir, mirror)
+}
+
+func (c *GitCache) lock(url string) *sync.Mutex {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.locks[url]; !ok {
+		c.locks[url] = new(sync.Mutex)
+	}
+	return c.locks[url]
+}
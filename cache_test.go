@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGitCacheClone(t *testing.T) {
+	repo := makeGitRepo(t, map[string]string{"file1": "one"})
+	defer os.RemoveAll(repo)
+	root, err := ioutil.TempDir("", "courier_test_cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	cache := NewGitCache(root)
+	url := "file://" + filepath.ToSlash(repo)
+	if cache.Has(url) {
+		t.Fatalf("GitCache: mirror exists before first clone")
+	}
+
+	clone := func() string {
+		dir, err := MakeTmpDir()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.Clone(context.Background(), dir, url); err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("GitCache: Clone: %v", err)
+		}
+		return dir
+	}
+
+	first := clone()
+	defer os.RemoveAll(first)
+	if !cache.Has(url) {
+		t.Fatalf("GitCache: mirror missing after clone")
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(first, "file1")); err != nil || string(buf) != "one" {
+		t.Errorf("GitCache: file1 = %q, %v; expected %q", buf, err, "one")
+	}
+
+	// New upstream commits must be fetched into the existing mirror.
+	sha := commitFiles(t, repo, map[string]string{"file2": "two"})
+	second := clone()
+	defer os.RemoveAll(second)
+	if got, err := GitGetSHA1(context.Background(), second); err != nil || got != sha {
+		t.Errorf("GitCache: HEAD = %q, %v; expected %q", got, err, sha)
+	}
+}
+
+func TestGitCacheMirrorDirDistinct(t *testing.T) {
+	cache := NewGitCache("root")
+	a := cache.MirrorDir("https://example.com/a/lib.git")
+	b := cache.MirrorDir("https://example.com/b/lib.git")
+	if a == b {
+		t.Errorf("GitCache: URLs share mirror dir %q", a)
+	}
+	if a != cache.MirrorDir("https://example.com/a/lib.git") {
+		t.Errorf("GitCache: mirror dir for the same URL is not stable")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// running is the commands RunCommand is running.
+var running = struct {
+	sync.Mutex
+	procs map[*os.Process]bool
+}{procs: make(map[*os.Process]bool)}
+
+// RunCommand runs cmd, killing it along with any processes it started, such
+// as the helpers Git runs to talk to remotes, when ctx is done. Killing just
+// cmd could leave those holding its output open, and so waiting on it.
+func RunCommand(ctx context.Context, cmd *exec.Cmd) error {
+	wait, err := StartCommand(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	return wait()
+}
+
+// StartCommand starts cmd like RunCommand, for when its output is read as it
+// runs, returning the function to wait for it with.
+func StartCommand(ctx context.Context, cmd *exec.Cmd) (wait func() error, err error) {
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	running.Lock()
+	running.procs[cmd.Process] = true
+	running.Unlock()
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd.Process)
+		case <-done:
+		}
+	}()
+	return func() error {
+		defer func() {
+			close(done)
+			running.Lock()
+			delete(running.procs, cmd.Process)
+			running.Unlock()
+		}()
+		return cmd.Wait()
+	}, nil
+}
+
+// KillRunningCommands kills every command RunCommand is running, along with
+// any processes they started, for when exiting without waiting on them.
+func KillRunningCommands() {
+	running.Lock()
+	defer running.Unlock()
+	for p := range running.procs {
+		killProcessGroup(p)
+	}
+}
+
+// CombinedOutput runs cmd like RunCommand, returning its combined stdout and
+// stderr.
+func CombinedOutput(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := RunCommand(ctx, cmd)
+	return out.Bytes(), err
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestCombinedOutputTimeout(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found on PATH")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// The shell's child keeps the output open after the shell's killed.
+	start := time.Now()
+	if _, err := CombinedOutput(ctx, exec.Command("sh", "-c", "sleep 3; true")); err == nil {
+		t.Errorf("CombinedOutput: expected error for command that timed out")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("CombinedOutput: returned after %v, expected soon after the timeout", elapsed)
+	}
+}
+
+func TestKillRunningCommands(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found on PATH")
+	}
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		_, err := CombinedOutput(context.Background(), exec.Command("sh", "-c", "sleep 3; true"))
+		done <- err
+	}()
+	for {
+		running.Lock()
+		n := len(running.procs)
+		running.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	KillRunningCommands()
+	if err := <-done; err == nil {
+		t.Errorf("CombinedOutput: expected error for command that was killed")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("KillRunningCommands: command returned after %v, expected straight away", elapsed)
+	}
+}
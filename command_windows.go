@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup does nothing; there are no process groups to kill on
+// Windows.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills p.
+func killProcessGroup(p *os.Process) {
+	_ = p.Kill() // If this errors out, it's already gone.
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// DependencyDiff describes how the copy of a pinned dependency differs from
+// it, file by file.
+type DependencyDiff struct {
+	Dir     string `json:"dir"`
+	Missing bool   `json:"missing,omitempty"`
+	DirDiff
+	Patch string `json:"patch,omitempty"` // With --patch.
+}
+
+func diffDependencies(ctx context.Context, patterns []string) error {
+	start := time.Now()
+
+	pinned, err := readPinnedManifest(ctx)
+	if err != nil {
+		return err
+	}
+	if len(patterns) > 0 {
+		pinned, err = SelectDependencies(pinned, patterns)
+		if err != nil {
+			return err
+		}
+	}
+
+	diffs, err := DiffDependencies(ctx, pinned, cmdLineArgs.patch)
+	if err != nil {
+		return err
+	}
+
+	for i, d := range diffs {
+		EmitEvent(Event{Event: "diff", Dir: d.Dir, Diff: &diffs[i]})
+		if cmdLineArgs.output == "json" {
+			continue
+		}
+		if d.Missing {
+			fmt.Printf("missing  %s\n", d.Dir)
+			continue
+		}
+		fmt.Printf("differs  %s: %d added, %d removed, %d modified, %d mode changed\n",
+			d.Dir, len(d.Added), len(d.Removed), len(d.Modified), len(d.ModeChanged))
+		printDirDiff("    ", d.DirDiff)
+		fmt.Print(d.Patch)
+	}
+	if len(diffs) == 0 {
+		LogInfo("All dependencies match %q", cmdLineArgs.pinnedManifest)
+	}
+	EmitEvent(Event{Event: "finished", DurationMS: msSince(start)})
+	return nil
+}
+
+// DiffDependencies stages each pinned dependency and compares it, file by
+// file, with what is on disk, without copying anything. It returns the
+// dependencies that differ, sorted by dir, with a patch from the pinned to
+// the copied contents if withPatch is set.
+func DiffDependencies(ctx context.Context, pinned Manifest, withPatch bool) ([]DependencyDiff, error) {
+
+	stagedDeps, err := StageDependencies(ctx, pinned)
+	if err != nil {
+		return nil, err
+	}
+	defer removeStaged(stagedDeps)
+
+	var dirs []string
+	for dir := range stagedDeps {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	diffs := []DependencyDiff{}
+	for _, dir := range dirs {
+		stagedDep := stagedDeps[dir]
+		src := path.Join(stagedDep.StagingDir, stagedDep.Pinned.DirToCopy())
+		d := DependencyDiff{Dir: dir}
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			d.Missing = true
+			diffs = append(diffs, d)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		d.DirDiff, err = DiffDirs(src, dir, DependencyFiles(stagedDep.Pinned))
+		if err != nil {
+			return nil, err
+		}
+		if d.Empty() {
+			continue
+		}
+		if withPatch {
+			d.Patch, err = DiffPatch(src, dir, d.DirDiff)
+			if err != nil {
+				return nil, err
+			}
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffDependencies(t *testing.T) {
+	repo := makeGitRepo(t, map[string]string{"same": "same\n", "edited": "one\ntwo\nthree\n", "deleted": "gone\n", "tool": "#!/bin/sh\n"})
+	defer os.RemoveAll(repo)
+	sha := runGit(t, repo, "rev-parse", "HEAD")
+	project, err := ioutil.TempDir("", "courier_test_project_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(project)
+
+	oldCache := gitCache
+	defer func() { gitCache = oldCache }()
+	gitCache = nil
+
+	clean, changed, missing := filepath.Join(project, "a"), filepath.Join(project, "b"), filepath.Join(project, "c")
+	for dir, files := range map[string]map[string]string{
+		clean:   {"same": "same\n", "edited": "one\ntwo\nthree\n", "deleted": "gone\n", "tool": "#!/bin/sh\n"},
+		changed: {"same": "same\n", "edited": "one\n2\nthree\n", "added": "new", "tool": "#!/bin/sh\n"},
+	} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for name, contents := range files {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := os.Chmod(filepath.Join(changed, "tool"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	pin := GitDependency{VCS: "git", URL: "file://" + filepath.ToSlash(repo), Ref: sha, Dir: ""}
+	diffs, err := DiffDependencies(context.Background(), Manifest{clean: pin, changed: pin, missing: pin}, true)
+	if err != nil {
+		t.Fatalf("DiffDependencies: %v", err)
+	}
+	expected := []DependencyDiff{
+		{Dir: changed, DirDiff: DirDiff{
+			Added:       []string{"added"},
+			Removed:     []string{"deleted"},
+			Modified:    []string{"edited"},
+			ModeChanged: []string{"tool"},
+		}, Patch: `--- /dev/null
++++ b/added
+@@ -0,0 +1 @@
++new
+\ No newline at end of file
+--- a/deleted
++++ /dev/null
+@@ -1 +0,0 @@
+-gone
+--- a/edited
++++ b/edited
+@@ -1,3 +1,3 @@
+ one
+-two
++2
+ three
+`},
+		{Dir: missing, Missing: true},
+	}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("DiffDependencies: got %#v, expected %#v", diffs, expected)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	var old, new []byte
+	for i := 1; i <= 20; i++ {
+		line := []byte{byte('a' + i), '\n'}
+		old = append(old, line...)
+		if i != 2 && i != 18 {
+			new = append(new, line...)
+		}
+	}
+	expected := `--- a/f
++++ b/f
+@@ -1,5 +1,4 @@
+ b
+-c
+ d
+ e
+ f
+@@ -15,6 +14,5 @@
+ p
+ q
+ r
+-s
+ t
+ u
+`
+	if got := UnifiedDiff("a/f", "b/f", old, new); got != expected {
+		t.Errorf("UnifiedDiff: got\n%s\nexpected\n%s", got, expected)
+	}
+	if got := UnifiedDiff("a/f", "b/f", old, old); got != "" {
+		t.Errorf("UnifiedDiff of the same contents: got %q", got)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	for _, test := range []struct {
+		a, b  string
+		edits int
+	}{
+		{"abcabba", "cbabac", 5},
+		{"abc", "", 3},
+		{"", "abc", 3},
+		{"abcdef", "abXdef", 2},
+		{"xyz", "abc", 6},
+	} {
+		a, b := strings.Split(test.a, ""), strings.Split(test.b, "")
+		var gotA, gotB []string
+		edits := 0
+		for _, op := range diffLines(a, b) {
+			if op.kind != '+' {
+				gotA = append(gotA, op.line)
+			}
+			if op.kind != '-' {
+				gotB = append(gotB, op.line)
+			}
+			if op.kind != ' ' {
+				edits++
+			}
+		}
+		if strings.Join(gotA, "") != test.a || strings.Join(gotB, "") != test.b || edits != test.edits {
+			t.Errorf("diffLines: %q to %q: got %q to %q in %d edits, expected %d", test.a, test.b, gotA, gotB, edits, test.edits)
+		}
+	}
+}
+
+func TestDiffPatchLongFile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "courier_test_diff_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	long := strings.Repeat("line\n", maxDiffLines)
+	writeFiles(t, filepath.Join(tmp, "a"), map[string]string{"f": long})
+	writeFiles(t, filepath.Join(tmp, "b"), map[string]string{"f": long + "more\n"})
+	patch, err := DiffPatch(filepath.Join(tmp, "a"), filepath.Join(tmp, "b"), DirDiff{Modified: []string{"f"}})
+	if expected := "Files a/f and b/f differ\n"; err != nil || patch != expected {
+		t.Errorf("DiffPatch: got %q, %v, expected %q", patch, err, expected)
+	}
+}
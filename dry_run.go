@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+)
+
+// Change describes what copying a staged dependency into place would do.
+type Change struct {
+	Dir         string `json:"dir"`
+	Copy        bool   `json:"copy"`
+	OldRevision string `json:"old_revision,omitempty"`
+	NewRevision string `json:"new_revision"`
+	DirDiff
+}
+
+// showChanges prints what copying the staged dependencies into place and
+// pinning them would change, given their existing pins.
+func showChanges(stagedDeps map[string]StagedDependency, pinned Manifest) error {
+	changes, err := PlanChanges(stagedDeps, pinned)
+	if err != nil {
+		return err
+	}
+
+	for i, c := range changes {
+		EmitEvent(Event{Event: "planned", Dir: c.Dir, Change: &changes[i]})
+		if cmdLineArgs.output == "json" {
+			continue
+		}
+		revisions := c.NewRevision
+		if c.OldRevision != c.NewRevision {
+			revisions = fmt.Sprintf("%s -> %s", displayRevision(c.OldRevision), displayRevision(c.NewRevision))
+		}
+		if !c.Copy {
+			fmt.Printf("skip  %s  (%s)\n", c.Dir, revisions)
+			continue
+		}
+		fmt.Printf("copy  %s  (%s): %d added, %d removed, %d modified\n",
+			c.Dir, revisions, len(c.Added), len(c.Removed), len(c.Modified))
+		printDirDiff("    ", c.DirDiff)
+	}
+	LogInfo("Dry run, nothing was changed")
+	return nil
+}
+
+// printDirDiff prints each file in d, after indent, prefixed by whether it
+// was added (A), removed (D), modified (M) or made (non-)executable (X).
+func printDirDiff(indent string, d DirDiff) {
+	for _, p := range d.Added {
+		fmt.Printf("%sA %s\n", indent, p)
+	}
+	for _, p := range d.Removed {
+		fmt.Printf("%sD %s\n", indent, p)
+	}
+	for _, p := range d.Modified {
+		fmt.Printf("%sM %s\n", indent, p)
+	}
+	for _, p := range d.ModeChanged {
+		fmt.Printf("%sX %s\n", indent, p)
+	}
+}
+
+// displayRevision returns rev, or "none" if there isn't one.
+func displayRevision(rev string) string {
+	if rev == "" {
+		return "none"
+	}
+	return rev
+}
+
+// PlanChanges works out, for each staged dependency, whether it would be
+// copied, from which pinned revision to which, and which files would change.
+func PlanChanges(stagedDeps map[string]StagedDependency, pinned Manifest) ([]Change, error) {
+	var dirs []string
+	for dir := range stagedDeps {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	changes := make([]Change, len(dirs))
+	for i, dir := range dirs {
+		stagedDep := stagedDeps[dir]
+		c := &changes[i]
+		c.Dir = dir
+		c.NewRevision = stagedDep.Pinned.Revision()
+		if pin, ok := pinned[dir]; ok {
+			c.OldRevision = pin.Revision()
+		}
+
+		changed, err := needsCopy(dir, stagedDep)
+		if err != nil {
+			return nil, err
+		}
+		c.Copy = changed
+		if !changed {
+			continue
+		}
+		src := path.Join(stagedDep.StagingDir, stagedDep.Pinned.DirToCopy())
+		c.DirDiff, err = DiffDirs(dir, src, DependencyFiles(stagedDep.Pinned))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
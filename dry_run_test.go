@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPlanChanges(t *testing.T) {
+	root, err := ioutil.TempDir("", "courier_test_plan_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	files := map[string]string{
+		"old/same":          "same",
+		"old/changed":       "before",
+		"old/gone":          "gone",
+		"old/.git/ignored":  "ignored",
+		"new/same":          "same",
+		"new/changed":       "after",
+		"new/sub/new":       "new",
+		"unchanged/file":    "file",
+		"staged/other/file": "file",
+	}
+	for p, contents := range files {
+		p = filepath.Join(root, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash, err := CreateDirHash(filepath.Join(root, "unchanged"), FileFilter{IgnoreDir: ".git"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldDir, unchangedDir := filepath.Join(root, "old"), filepath.Join(root, "unchanged")
+	stagedDeps := map[string]StagedDependency{
+		oldDir: {
+			StagingDir: filepath.Join(root, "new"),
+			Pinned:     GitDependency{VCS: "git", Ref: "new", Hash: "sha256:new"},
+		},
+		unchangedDir: {
+			StagingDir: filepath.Join(root, "staged"),
+			Pinned:     GitDependency{VCS: "git", Ref: "same", Dir: "other", Hash: FormatDirHash(hash)},
+		},
+	}
+	pinned := Manifest{oldDir: GitDependency{VCS: "git", Ref: "old"}}
+
+	changes, err := PlanChanges(stagedDeps, pinned)
+	if err != nil {
+		t.Fatalf("PlanChanges: %v", err)
+	}
+	expected := []Change{
+		{Dir: oldDir, Copy: true, OldRevision: "old", NewRevision: "new",
+			DirDiff: DirDiff{Added: []string{"sub/new"}, Removed: []string{"gone"}, Modified: []string{"changed"}}},
+		{Dir: unchangedDir, NewRevision: "same"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("PlanChanges: got %+v, expected %+v", changes, expected)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// StepError is the error from one step of obtaining a dependency, such as
+// running a command.
+type StepError struct {
+	Step   string // e.g. "clone", "checkout", "stat" or "rev-parse".
+	Err    error
+	Output string // What the command output, if anything.
+}
+
+func (e *StepError) Error() string {
+	if e.Output == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Err.Error(), e.Output)
+}
+
+// stepError returns err as the error from step, unless it's already from a
+// step or nil.
+func stepError(step string, err error) error {
+	if _, ok := err.(*StepError); ok || err == nil {
+		return err
+	}
+	return &StepError{Step: step, Err: err}
+}
+
+// commandError returns the error from a command run as step, given what it
+// output.
+func commandError(step string, err error, out []byte) error {
+	return &StepError{Step: step, Err: err, Output: trim(out)}
+}
+
+// A sourcedDependency can say where it's obtained from.
+type sourcedDependency interface {
+	Source() string
+}
+
+// DependencySource returns where dep is obtained from, such as its URL, or ""
+// if it can't say.
+func DependencySource(dep Dependency) string {
+	if d, ok := dep.(sourcedDependency); ok {
+		return d.Source()
+	}
+	return ""
+}
+
+// DependencyError describes why a dependency couldn't be obtained.
+type DependencyError struct {
+	Dir    string `json:"dir"`
+	VCS    string `json:"vcs"`
+	URL    string `json:"url"`
+	Step   string `json:"step"`
+	Error  string `json:"error"`
+	Output string `json:"output,omitempty"`
+}
+
+// NewDependencyError describes the error from obtaining dep into dir.
+func NewDependencyError(dir string, dep Dependency, err error) DependencyError {
+	e := DependencyError{Dir: dir, VCS: dep.Kind(), URL: DependencySource(dep), Step: "stage", Error: err.Error()}
+	if stepErr, ok := err.(*StepError); ok {
+		e.Step, e.Error, e.Output = stepErr.Step, stepErr.Err.Error(), stepErr.Output
+	}
+	return e
+}
+
+// StagingError is the error from staging dependencies, recording each one
+// that failed.
+type StagingError struct {
+	Failed []DependencyError `json:"failed"`
+}
+
+func (e *StagingError) Error() string {
+	dirs := make([]string, len(e.Failed))
+	for i, f := range e.Failed {
+		dirs[i] = fmt.Sprintf("%q", f.Dir)
+	}
+	return fmt.Sprintf("failed to stage dependencies %s", strings.Join(dirs, ", "))
+}
+
+// byDir sorts failed dependencies by dir.
+type byDir []DependencyError
+
+func (s byDir) Len() int           { return len(s) }
+func (s byDir) Less(i, j int) bool { return s[i].Dir < s[j].Dir }
+func (s byDir) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Report writes a summary of the failed dependencies to stdout, as a table or
+// as a "failed" event.
+func (e *StagingError) Report(format string) error {
+	if format == "json" {
+		EmitEvent(Event{Event: "failed", Error: e.Error(), Failed: e.Failed})
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "DEPENDENCY\tVCS\tURL\tSTEP\tERROR\n")
+	for _, f := range e.Failed {
+		msg := f.Error
+		if f.Output != "" {
+			msg += ": " + strings.Replace(f.Output, "\n", " ", -1)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", f.Dir, f.VCS, f.URL, f.Step, msg)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestStageDependenciesErrors(t *testing.T) {
+	missing := "/nonexistent/courier_test"
+	_, err := StageDependencies(context.Background(), Manifest{
+		"b": GitDependency{VCS: "git", URL: "file://" + missing, Ref: "master"},
+		"a": LocalDependency{VCS: "local", Path: missing},
+	})
+	stagingErr, ok := err.(*StagingError)
+	if !ok {
+		t.Fatalf("StageDependencies: got error %v, expected a *StagingError", err)
+	}
+	expected := []struct{ dir, vcs, url, step string }{
+		{"a", "local", missing, "stat"},
+		{"b", "git", "file://" + missing, "clone"},
+	}
+	if len(stagingErr.Failed) != len(expected) {
+		t.Fatalf("StageDependencies: got %d failures, expected %d", len(stagingErr.Failed), len(expected))
+	}
+	for i, e := range expected {
+		f := stagingErr.Failed[i]
+		if f.Dir != e.dir || f.VCS != e.vcs || f.URL != e.url || f.Step != e.step || f.Error == "" {
+			t.Errorf("StageDependencies: failure %d is %+v, expected %+v", i, f, e)
+		}
+	}
+	if stagingErr.Failed[1].Output == "" {
+		t.Errorf("StageDependencies: expected the output of git clone")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event is something that happened during a run. With --output json, each is
+// written to stdout as a line of JSON. The events are:
+//
+//	stage_started   a dependency started being staged
+//	stage_finished  a dependency was staged, at revision
+//	skipped         a dependency wasn't staged or copied, for reason
+//	copied          a dependency was copied into place
+//	restored        a copied dependency was put back as it was
+//	pinned          a dependency was pinned, at revision, with hash
+//	planned         with --dry-run, the change copying a dependency would make
+//	status          with status, how a dependency has drifted
+//	mismatch        with verify, a copy differs from its pin, for reason
+//	diff            with diff, the files of a copy that differ from its pin
+//	error           a dependency, or the run, failed at step
+//	failed          the run failed, because of the failed dependencies
+//	finished        the run finished
+type Event struct {
+	Time       time.Time         `json:"time"`
+	Event      string            `json:"event"`
+	Dir        string            `json:"dir,omitempty"`
+	VCS        string            `json:"vcs,omitempty"`
+	Revision   string            `json:"revision,omitempty"`
+	Hash       string            `json:"hash,omitempty"`
+	Reason     string            `json:"reason,omitempty"`
+	DurationMS int64             `json:"duration_ms,omitempty"`
+	Step       string            `json:"step,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Failed     []DependencyError `json:"failed,omitempty"`
+	Change     *Change           `json:"change,omitempty"`
+	Status     *DependencyStatus `json:"status,omitempty"`
+	Diff       *DependencyDiff   `json:"diff,omitempty"`
+}
+
+// eventOutput is where events are written.
+var eventOutput io.Writer = os.Stdout
+
+var eventMu sync.Mutex
+
+// EmitEvent writes e, timestamped now, if events are wanted.
+func EmitEvent(e Event) {
+	if cmdLineArgs.output != "json" {
+		return
+	}
+	e.Time = time.Now().UTC()
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	_ = json.NewEncoder(eventOutput).Encode(e) // If stdout is gone, there's not much we can do.
+}
+
+// msSince returns the milliseconds since start.
+func msSince(start time.Time) int64 {
+	return int64(time.Since(start) / time.Millisecond)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStageDependenciesEvents(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(output string) { eventOutput, cmdLineArgs.output = os.Stdout, output }(cmdLineArgs.output)
+	eventOutput, cmdLineArgs.output = &buf, "json"
+
+	src, err := ioutil.TempDir("", "courier_test_local_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	if err := ioutil.WriteFile(filepath.Join(src, "file1"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stagedDeps, err := StageDependencies(context.Background(), Manifest{"dep": LocalDependency{VCS: "local", Path: src}})
+	if err != nil {
+		t.Fatalf("StageDependencies: %v", err)
+	}
+	defer os.RemoveAll(stagedDeps["dep"].StagingDir)
+
+	dec := json.NewDecoder(&buf)
+	for _, expected := range []string{"stage_started", "stage_finished"} {
+		var e Event
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		if e.Event != expected || e.Dir != "dep" || e.VCS != "local" || e.Time.IsZero() {
+			t.Errorf("StageDependencies: got event %+v, expected %q for %q", e, expected, "dep")
+		}
+		if e.Event == "stage_finished" && e.Revision != stagedDeps["dep"].Pinned.Revision() {
+			t.Errorf("StageDependencies: got revision %q, expected %q", e.Revision, stagedDeps["dep"].Pinned.Revision())
+		}
+	}
+	if dec.More() {
+		t.Errorf("StageDependencies: unexpected further events")
+	}
+}
+
+func TestVerifyEvents(t *testing.T) {
+	var buf bytes.Buffer
+	oldArgs := cmdLineArgs
+	defer func() { eventOutput, cmdLineArgs = os.Stdout, oldArgs }()
+	eventOutput, cmdLineArgs.output = &buf, "json"
+
+	tmp, err := ioutil.TempDir("", "courier_test_events_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src, dst := filepath.Join(tmp, "src"), filepath.Join(tmp, "dst")
+	writeFiles(t, src, map[string]string{"file1": "contents"})
+	writeFiles(t, dst, map[string]string{"file1": "edited"})
+	cmdLineArgs.pinnedManifest = filepath.Join(tmp, "pins.json")
+	if err := savePinnedManifest(Manifest{dst: LocalDependency{VCS: "local", Path: src}}); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+
+	if err := verifyDependencies(context.Background()); err == nil {
+		t.Errorf("verifyDependencies: expected error for modified dependency")
+	}
+
+	// Everything written is an event, one per line.
+	var events []string
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var e Event
+		if err := json.Unmarshal(line, &e); err != nil {
+			t.Fatalf("verifyDependencies: output %q isn't an event: %v", line, err)
+		}
+		events = append(events, e.Event)
+		if e.Event == "mismatch" && (e.Dir != dst || e.Reason != StatusModified) {
+			t.Errorf("verifyDependencies: got event %+v", e)
+		}
+	}
+	if expected := []string{"stage_started", "stage_finished", "mismatch"}; !reflect.DeepEqual(events, expected) {
+		t.Errorf("verifyDependencies: got events %q, expected %q", events, expected)
+	}
+}
@@ -1,13 +1,14 @@
 package main
 
 import (
-	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -24,13 +25,81 @@ func MakeTmpDir() (dir string, err error) {
 	return ioutil.TempDir("", fmt.Sprintf("courier_%s_", username))
 }
 
-func CopyDirContents(srcDir, dstDir, ignoreDir string) error {
+// CopyDirContents replaces dstDir with a copy of the files of srcDir kept by
+// files. If copying fails, dstDir is left as it was.
+func CopyDirContents(srcDir, dstDir string, files FileFilter) error {
+	backup, err := ReplaceDirContents(srcDir, dstDir, files)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(backup)
+}
+
+// ReplaceDirContents is like CopyDirContents, except that rather than being
+// removed, what was in dstDir is kept in the returned backup dir, so that it
+// can be put back with RestoreDir. The backup is "" if dstDir didn't exist.
+func ReplaceDirContents(srcDir, dstDir string, files FileFilter) (backup string, err error) {
 
 	LogDebug(`Copying directory contents from %q to %q`, srcDir, dstDir)
 
-	// Ignore the error, since the directory may not exist. If there are any
-	// 'stat' type errors, then they will be caught when we start copying.
-	_ = os.RemoveAll(dstDir)
+	srcInfo, err := os.Stat(srcDir)
+	if err != nil {
+		return "", err
+	}
+
+	// Copy into a dir next to dstDir, so that it can be renamed into place
+	// once complete.
+	parent := filepath.Dir(dstDir)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempDir(parent, ".courier_tmp_")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp) // Only left behind if something went wrong.
+	if err := os.Chmod(tmp, srcInfo.Mode().Perm()); err != nil {
+		return "", err
+	}
+	if err := copyDir(srcDir, tmp, files); err != nil {
+		return "", err
+	}
+
+	// Swap it in, moving what was there out of the way.
+	if _, err := os.Lstat(dstDir); err == nil {
+		backup = tmp + "_backup"
+		LogDebug(`Moving %q to %q`, dstDir, backup)
+		if err := os.Rename(dstDir, backup); err != nil {
+			return "", err
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	if err := os.Rename(tmp, dstDir); err != nil {
+		if backup != "" {
+			_ = os.Rename(backup, dstDir) // If this errors out, there's not much we can do.
+		}
+		return "", err
+	}
+	return backup, nil
+}
+
+// RestoreDir puts back what was in dir before ReplaceDirContents returned
+// backup.
+func RestoreDir(dir, backup string) error {
+	LogDebug(`Restoring %q from %q`, dir, backup)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if backup == "" {
+		return nil
+	}
+	return os.Rename(backup, dir)
+}
+
+// copyDir copies the files of srcDir kept by files into dstDir, which must
+// exist.
+func copyDir(srcDir, dstDir string, files FileFilter) error {
 
 	// Copy the files from src to dst. This is a bit painful in Go...
 	return filepath.Walk(srcDir, func(p string, info os.FileInfo, err error) error {
@@ -39,8 +108,8 @@ func CopyDirContents(srcDir, dstDir, ignoreDir string) error {
 			return err
 		}
 
-		if info.IsDir() && info.Name() == ignoreDir {
-			return filepath.SkipDir
+		if keep, err := files.keeps(srcDir, p, info); !keep {
+			return err
 		}
 
 		rel, err := filepath.Rel(srcDir, p)
@@ -68,6 +137,9 @@ func CopyDirContents(srcDir, dstDir, ignoreDir string) error {
 			// only way to do things so that it works for both Linux and
 			// Windows without modification.
 			LogDebug(`Copying file from %q to %q`, src, dst)
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil { // Its dir may have been left out.
+				return err
+			}
 			if buf, err := ioutil.ReadFile(src); err != nil {
 				return err
 			} else if err := ioutil.WriteFile(dst, buf, info.Mode()); err != nil {
@@ -78,10 +150,17 @@ func CopyDirContents(srcDir, dstDir, ignoreDir string) error {
 	})
 }
 
-func CreateDirHash(dir string, ignoreDir string) ([]byte, error) {
+// FormatDirHash formats a hash from CreateDirHash for storing in a manifest.
+func FormatDirHash(hash []byte) string {
+	return fmt.Sprintf("sha256:%x", hash)
+}
+
+// CreateDirHash hashes the names, modes and contents of the files of dir kept
+// by files.
+func CreateDirHash(dir string, files FileFilter) ([]byte, error) {
 	LogDebug(`Creating directory hash for %q`, dir)
 
-	hash := sha1.New()
+	hash := sha256.New()
 	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -97,8 +176,8 @@ func CreateDirHash(dir string, ignoreDir string) ([]byte, error) {
 		}
 
 		LogDebug(`Base path: %q`, info.Name())
-		if info.IsDir() && info.Name() == ignoreDir {
-			return filepath.SkipDir
+		if keep, err := files.keeps(dir, p, info); !keep {
+			return err
 		}
 
 		// Get the path relative to the folder we're hashing
@@ -111,8 +190,8 @@ func CreateDirHash(dir string, ignoreDir string) ([]byte, error) {
 		LogDebug(`Hashing filename: %q`, rel)
 		hash.Write([]byte(rel))
 		// Hash the file mode.
-		LogDebug(`Hashing the mode: %q`, info.Mode().String())
-		hash.Write([]byte(info.Mode().String()))
+		LogDebug(`Hashing the mode: %q`, hashedMode(info.Mode()))
+		hash.Write([]byte(hashedMode(info.Mode())))
 		// Hash the file contents.
 		switch {
 		case info.Mode().IsDir():
@@ -140,3 +219,111 @@ func CreateDirHash(dir string, ignoreDir string) ([]byte, error) {
 	LogDebug(`Hash for %q: %x`, dir, hash.Sum(nil))
 	return hash.Sum(nil), err
 }
+
+// hashedMode returns the part of a file mode that CreateDirHash hashes. Other
+// permission bits depend on the umask of whoever checked the files out, so
+// they're left out in order for hashes to be comparable between machines.
+func hashedMode(mode os.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "d"
+	case mode&0111 != 0:
+		return "x"
+	default:
+		return "-"
+	}
+}
+
+// DirDiff lists, as slash separated paths, the files that differ between two
+// directories.
+type DirDiff struct {
+	Added       []string `json:"added,omitempty"`
+	Removed     []string `json:"removed,omitempty"`
+	Modified    []string `json:"modified,omitempty"`     // The contents differ.
+	ModeChanged []string `json:"mode_changed,omitempty"` // Whether it's executable differs.
+}
+
+// Empty reports whether there are no differences.
+func (d DirDiff) Empty() bool {
+	return len(d.Added)+len(d.Removed)+len(d.Modified)+len(d.ModeChanged) == 0
+}
+
+// DiffDirs compares the files in oldDir and newDir kept by files. A missing
+// dir is treated as empty.
+func DiffDirs(oldDir, newDir string, files FileFilter) (DirDiff, error) {
+	var d DirDiff
+	oldFiles, err := digestFiles(oldDir, files)
+	if err != nil && !os.IsNotExist(err) {
+		return DirDiff{}, err
+	}
+	newFiles, err := digestFiles(newDir, files)
+	if err != nil && !os.IsNotExist(err) {
+		return DirDiff{}, err
+	}
+	for p, newDigest := range newFiles {
+		oldDigest, ok := oldFiles[p]
+		if !ok {
+			d.Added = append(d.Added, p)
+			continue
+		}
+		if oldDigest.sum != newDigest.sum {
+			d.Modified = append(d.Modified, p)
+		}
+		if oldDigest.mode != newDigest.mode {
+			d.ModeChanged = append(d.ModeChanged, p)
+		}
+	}
+	for p := range oldFiles {
+		if _, ok := newFiles[p]; !ok {
+			d.Removed = append(d.Removed, p)
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Modified)
+	sort.Strings(d.ModeChanged)
+	return d, nil
+}
+
+type fileDigest struct {
+	mode string // As hashed by CreateDirHash.
+	sum  string
+}
+
+// digestFiles returns the digest of each file under dir kept by filter, by
+// slash separated path relative to dir.
+func digestFiles(dir string, filter FileFilter) (map[string]fileDigest, error) {
+	files := make(map[string]fileDigest)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		src, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			return err
+		}
+		info, err = os.Stat(src)
+		if err != nil {
+			return err
+		}
+		if keep, err := filter.keeps(dir, p, info); !keep || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		fp, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		hash := sha256.New()
+		if _, err := io.Copy(hash, fp); err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = fileDigest{hashedMode(info.Mode()), fmt.Sprintf("%x", hash.Sum(nil))}
+		return nil
+	})
+	return files, err
+}
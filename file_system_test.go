@@ -3,7 +3,9 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -43,7 +45,7 @@ var testsExpectedSame = [][]createDirHashTest{
 }
 
 func TestCreateDirHashNonExistent(t *testing.T) {
-	if _, err := CreateDirHash("some non existent file", ""); !os.IsNotExist(err) {
+	if _, err := CreateDirHash("some non existent file", FileFilter{}); !os.IsNotExist(err) {
 		t.Errorf("CreateDirHash: Expected error on non-existent file")
 	}
 }
@@ -51,7 +53,7 @@ func TestCreateDirHashNonExistent(t *testing.T) {
 func TestCreateDirHashExpectDifferent(t *testing.T) {
 	seen := make(map[string]string)
 	for _, test := range testsExpectedDifferent {
-		hash, err := CreateDirHash(test.dir, test.ignore)
+		hash, err := CreateDirHash(test.dir, FileFilter{IgnoreDir: test.ignore})
 		if err != nil {
 			t.Errorf("CreateDirHash: %q [%q]: Error: %v", test.dir, test.ignore, err)
 		}
@@ -69,7 +71,7 @@ func TestCreateDirHashExpectSame(t *testing.T) {
 	for _, tests := range testsExpectedSame {
 		var expected []byte
 		for _, test := range tests {
-			hash, err := CreateDirHash(test.dir, test.ignore)
+			hash, err := CreateDirHash(test.dir, FileFilter{IgnoreDir: test.ignore})
 			if err != nil {
 				t.Errorf("CreateDirHash: %q [%q]: Error: %v", test.dir, test.ignore, err)
 			}
@@ -98,11 +100,11 @@ func TestCreateDirHashPermissions(t *testing.T) {
 	if infoNoX.Mode() == infoWithX.Mode() {
 		t.Logf("Detected that execution bits are not supported; skipping test.")
 	} else {
-		hashNoX, err := CreateDirHash("./test/filesystem/test-x", "")
+		hashNoX, err := CreateDirHash("./test/filesystem/test-x", FileFilter{})
 		if err != nil {
 			t.Errorf("CreateDirHash: %q: Error: %v", "test-x", err)
 		}
-		hashWithX, err := CreateDirHash("./test/filesystem/test+x", "")
+		hashWithX, err := CreateDirHash("./test/filesystem/test+x", FileFilter{})
 		if err != nil {
 			t.Errorf("CreateDirHash: %q: Error: %v", "test+x", err)
 		}
@@ -111,3 +113,59 @@ func TestCreateDirHashPermissions(t *testing.T) {
 		}
 	}
 }
+
+func readTestFile(t *testing.T, p string) string {
+	buf, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Errorf("ReadFile: %v", err)
+	}
+	return string(buf)
+}
+
+func TestReplaceDirContents(t *testing.T) {
+	root, err := ioutil.TempDir("", "courier_test_replace_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	src, dst := filepath.Join(root, "src"), filepath.Join(root, "dst")
+	for dir, contents := range map[string]string{src: "new", dst: "old"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "file1"), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backup, err := ReplaceDirContents(src, dst, FileFilter{})
+	if err != nil {
+		t.Fatalf("ReplaceDirContents: %v", err)
+	}
+	if got := readTestFile(t, filepath.Join(dst, "file1")); got != "new" {
+		t.Errorf("ReplaceDirContents: copied %q, expected %q", got, "new")
+	}
+	if got := readTestFile(t, filepath.Join(backup, "file1")); got != "old" {
+		t.Errorf("ReplaceDirContents: backed up %q, expected %q", got, "old")
+	}
+	if err := RestoreDir(dst, backup); err != nil {
+		t.Fatalf("RestoreDir: %v", err)
+	}
+	if got := readTestFile(t, filepath.Join(dst, "file1")); got != "old" {
+		t.Errorf("RestoreDir: restored %q, expected %q", got, "old")
+	}
+
+	// A failed copy leaves the destination as it was, and nothing behind.
+	if err := os.Symlink("missing", filepath.Join(src, "broken")); err != nil {
+		t.Skipf("Symlink: %v", err)
+	}
+	if err := CopyDirContents(src, dst, FileFilter{}); err == nil {
+		t.Errorf("CopyDirContents: expected error for broken symlink")
+	}
+	if got := readTestFile(t, filepath.Join(dst, "file1")); got != "old" {
+		t.Errorf("CopyDirContents: left %q after failure, expected %q", got, "old")
+	}
+	if infos, err := ioutil.ReadDir(root); err != nil || len(infos) != 2 {
+		t.Errorf("CopyDirContents: left %d entries in %q after failure, expected 2", len(infos), root)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// PathFilter chooses which of the files in the dir to copy are copied.
+// Patterns are as for path.Match. One containing a slash, other than at the
+// end, is matched against the path from the dir to copy, and otherwise against
+// the name of each file and dir, as in a .gitignore file. A file is copied if
+// it, or a dir it's in, matches any include pattern, if there are any, and
+// none of the exclude patterns.
+type PathFilter struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+func (f PathFilter) Filtering() PathFilter { return f }
+
+// LoadPathFilter parses and removes the filter from the keys of a dependency,
+// before they're converted to strings.
+func LoadPathFilter(rawDep map[string]json.RawMessage) (PathFilter, error) {
+	var f PathFilter
+	for key, patterns := range map[string]*[]string{"include": &f.Include, "exclude": &f.Exclude} {
+		raw, ok := rawDep[key]
+		if !ok {
+			continue
+		}
+		if err := json.Unmarshal(raw, patterns); err != nil {
+			return PathFilter{}, fmt.Errorf("value of key '%s' must be a list of patterns", key)
+		}
+		for _, pattern := range *patterns {
+			if _, err := path.Match(pattern, ""); err != nil || strings.Trim(pattern, "/") == "" {
+				return PathFilter{}, fmt.Errorf("invalid pattern %q in key '%s'", pattern, key)
+			}
+		}
+		delete(rawDep, key)
+	}
+	return f, nil
+}
+
+// SameFilter reports whether a and b have the same patterns.
+func SameFilter(a, b PathFilter) bool {
+	return sameStrings(a.Include, b.Include) && sameStrings(a.Exclude, b.Exclude)
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// FileFilter chooses the files of a dependency that are copied, and so hashed
+// and compared.
+type FileFilter struct {
+	IgnoreDir string // Dirs of this name are always left out.
+	PathFilter
+}
+
+// DependencyFiles returns the filter of the files of dep.
+func DependencyFiles(dep Dependency) FileFilter {
+	return FileFilter{IgnoreDir: dep.IgnoreDir(), PathFilter: dep.Filtering()}
+}
+
+// keeps reports whether the file or dir p, found walking root, is kept. If a
+// dir's contents are all left out, it returns filepath.SkipDir.
+func (f FileFilter) keeps(root, p string, info os.FileInfo) (bool, error) {
+	if info.IsDir() && info.Name() == f.IgnoreDir {
+		return false, filepath.SkipDir
+	}
+	rel, err := filepath.Rel(root, p)
+	if err != nil || rel == "." {
+		return err == nil, err
+	}
+	rel = filepath.ToSlash(rel)
+	if matchAny(f.Exclude, rel) {
+		if info.IsDir() {
+			return false, filepath.SkipDir
+		}
+		return false, nil
+	}
+	return len(f.Include) == 0 || matchAny(f.Include, rel), nil
+}
+
+// matchAny reports whether any of patterns matches the slash separated path
+// rel, or a dir it's in.
+func matchAny(patterns []string, rel string) bool {
+	parts := strings.Split(rel, "/")
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(pattern, "/")
+		anchored := strings.Contains(pattern, "/")
+		pattern = strings.TrimPrefix(pattern, "/")
+		for i := range parts {
+			name := parts[i]
+			if anchored {
+				name = strings.Join(parts[:i+1], "/")
+			}
+			if matched, _ := path.Match(pattern, name); matched { // Checked by LoadPathFilter.
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMatchAny(t *testing.T) {
+	for _, test := range []struct {
+		pattern  string
+		rel      string
+		expected bool
+	}{
+		{"src/", "src/a.c", true},
+		{"src", "lib/src/a.c", true},
+		{"/src", "lib/src/a.c", false},
+		{"lib/src", "lib/src/a.c", true},
+		{"lib/*/a.c", "lib/src/a.c", true},
+		{"*.md", "docs/readme.md", true},
+		{"*.md", "readme.mdx", false},
+		{"tests/", "src/tests/t.c", true},
+		{"tests/", "src/tests.c", false},
+	} {
+		if matched := matchAny([]string{test.pattern}, test.rel); matched != test.expected {
+			t.Errorf("matchAny: %q %q: got %v, expected %v", test.pattern, test.rel, matched, test.expected)
+		}
+	}
+}
+
+func TestFileFilter(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "courier_test_filter_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src, dst := filepath.Join(tmp, "src"), filepath.Join(tmp, "dst")
+	writeFiles(t, src, map[string]string{
+		"include/a.h":       "a",
+		"include/readme.md": "docs",
+		"src/a.c":           "a",
+		"src/tests/t.c":     "test",
+		"docs/guide.txt":    "guide",
+		"readme.md":         "readme",
+		".git/HEAD":         "ref",
+	})
+	files := FileFilter{IgnoreDir: ".git", PathFilter: PathFilter{
+		Include: []string{"include/", "src/"},
+		Exclude: []string{"tests/", "*.md"},
+	}}
+
+	if err := CopyDirContents(src, dst, files); err != nil {
+		t.Fatalf("CopyDirContents: %v", err)
+	}
+	copied, err := digestFiles(dst, FileFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for name := range copied {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if expected := []string{"include/a.h", "src/a.c"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("CopyDirContents: copied %q, expected %q", names, expected)
+	}
+
+	// What's left out doesn't count towards the hash.
+	srcHash, err := CreateDirHash(src, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstHash, err := CreateDirHash(dst, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(srcHash, dstHash) {
+		t.Errorf("CreateDirHash: got %x for the source, %x for its copy", srcHash, dstHash)
+	}
+	if d, err := DiffDirs(src, dst, files); err != nil || !d.Empty() {
+		t.Errorf("DiffDirs: got %+v, %v, expected no differences", d, err)
+	}
+}
+
+func TestLoadPathFilter(t *testing.T) {
+	m, err := LoadManifest(context.Background(), []byte(`{"lib": {"vcs": "local", "path": "../lib", "include": ["src/"], "exclude": ["*.md"]}}`))
+	if err != nil {
+		t.Fatalf("LoadManifest: %v", err)
+	}
+	expected := PathFilter{Include: []string{"src/"}, Exclude: []string{"*.md"}}
+	if got := m["lib"].Filtering(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("LoadManifest: got %+v, expected %+v", got, expected)
+	}
+	for _, js := range []string{
+		`{"lib": {"vcs": "local", "path": "../lib", "include": "src/"}}`,
+		`{"lib": {"vcs": "local", "path": "../lib", "exclude": ["[a-"]}}`,
+		`{"lib": {"vcs": "local", "path": "../lib", "exclude": ["/"]}}`,
+	} {
+		if _, err := LoadManifest(context.Background(), []byte(js)); err == nil {
+			t.Errorf("LoadManifest: %s: expected error", js)
+		}
+	}
+}
@@ -1,41 +1,307 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
 	"os/exec"
 	"strings"
 )
 
+func init() {
+	RegisterBackend("git", gitBackend{})
+}
+
+type GitDependency struct {
+	VCS  string `json:"vcs"` // XXX it doesn't make sense from a data model point of view to have this field. It's to help converting to JSON.
+	URL  string `json:"url"`
+	Ref  string `json:"ref"`
+	Dir  string `json:"dir"`
+	Tag  string `json:"tag,omitempty"` // The tag a pin was made from.
+	Hash string `json:"hash,omitempty"`
+	CommonKeys
+}
+
+func (d GitDependency) Kind() string        { return "git" }
+func (d GitDependency) IgnoreDir() string   { return ".git" }
+func (d GitDependency) DirToCopy() string   { return d.Dir }
+func (d GitDependency) Revision() string    { return d.Ref }
+func (d GitDependency) Immutable() bool     { return IsImmutableGitRef(d.Ref) }
+func (d GitDependency) PinnedFrom() string  { return d.Tag }
+func (d GitDependency) ContentHash() string { return d.Hash }
+func (d GitDependency) Host() string        { return urlHost(d.URL) }
+func (d GitDependency) Source() string      { return d.URL }
+func (d GitDependency) SameSource(other Dependency) bool {
+	o, ok := other.(GitDependency)
+	return ok && o.URL == d.URL && o.Dir == d.Dir
+}
+func (d GitDependency) WithContentHash(hash string) Dependency {
+	d.Hash = hash
+	return d
+}
+func (d GitDependency) WithCommon(common CommonKeys) Dependency {
+	d.CommonKeys = common
+	return d
+}
+func (d GitDependency) WithDir(dir string) Dependency {
+	d.Dir = dir
+	return d
+}
+
+func LoadGitDependency(depMap map[string]string) (GitDependency, error) {
+	d := GitDependency{VCS: "git"}
+	var ok bool
+	if d.URL, ok = depMap["url"]; !ok {
+		return GitDependency{}, errors.New("missing required key 'url'")
+	}
+	if d.Ref, ok = depMap["ref"]; !ok {
+		return GitDependency{}, errors.New("missing required key 'ref'")
+	}
+	if d.Dir, ok = depMap["dir"]; !ok {
+		return GitDependency{}, errors.New("missing required key 'dir'")
+	}
+	if err := checkDir(d.Dir); err != nil {
+		return GitDependency{}, err
+	}
+	d.Tag = depMap["tag"]
+	d.Hash = depMap["hash"]
+	delete(depMap, "vcs")
+	delete(depMap, "url")
+	delete(depMap, "ref")
+	delete(depMap, "dir")
+	delete(depMap, "tag")
+	delete(depMap, "hash")
+	for k, v := range depMap {
+		LogWarn(`Ignoring unknown key value pair %q:%q`, k, v)
+	}
+	return d, nil
+}
+
+type gitBackend struct{}
+
+func (gitBackend) Load(ctx context.Context, depMap map[string]string) (Dependency, error) {
+	return LoadGitDependency(depMap)
+}
+
+func (gitBackend) Stage(ctx context.Context, dep Dependency, stagingDir string) (Dependency, error) {
+	gitDep := dep.(GitDependency)
+
+	// Get the right commit into the staging dir.
+	if err := fetchGitDependency(ctx, stagingDir, gitDep); err != nil {
+		return nil, err
+	}
+
+	// Get the SHA1 so we can reproduce the exact version of the external, and
+	// keep the tag it was, so its pin can be reused.
+	sha, err := GitGetSHA1(ctx, stagingDir)
+	if err != nil {
+		return nil, err
+	}
+	if IsImmutableGitRef(gitDep.Ref) && !IsGitSHA1(gitDep.Ref) {
+		gitDep.Tag = gitDep.Ref
+	}
+	gitDep.Ref = sha
+	return gitDep, nil
+}
+
+func (gitBackend) Resolve(ctx context.Context, dep Dependency) (string, error) {
+	gitDep := dep.(GitDependency)
+	return GitResolveRef(ctx, gitDep.URL, gitDep.Ref)
+}
+
+// fetchGitDependency populates dir with the commit dep refers to. If the ref
+// can't move, only that commit is fetched. Otherwise the repository is cloned,
+// by way of the cache if there is one.
+func fetchGitDependency(ctx context.Context, dir string, dep GitDependency) error {
+
+	if ref := ""; cmdLineArgs.shallow && (gitCache == nil || !gitCache.Has(dep.URL)) {
+		if ref = dep.Ref; !IsImmutableGitRef(ref) {
+			ref = shortGitTag(ctx, dep.URL, ref)
+		}
+		if ref != "" {
+			var sparseDir string
+			if cmdLineArgs.sparse && dep.MappedFrom == "" { // Others may share the checkout.
+				sparseDir = dep.Dir
+			}
+			err := GitShallowFetch(ctx, dir, dep.URL, ref, sparseDir)
+			if err == nil {
+				return nil
+			}
+
+			// Not all servers allow fetching arbitrary commits, so start
+			// again with a full clone.
+			LogWarn(`Shallow fetch of %q failed, falling back to a full clone: %v`, dep.URL, err)
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+			if err := os.Mkdir(dir, 0700); err != nil {
+				return err
+			}
+		}
+	}
+
+	var err error
+	if gitCache != nil {
+		err = gitCache.Clone(ctx, dir, dep.URL)
+	} else {
+		err = GitClone(ctx, dir, dep.URL)
+	}
+	if err != nil {
+		return err
+	}
+	return GitCheckout(ctx, dir, dep.Ref)
+}
+
 func trim(p []byte) string {
 	return strings.TrimSpace(string(p))
 }
 
-func GitClone(dir, url string) error {
+func GitClone(ctx context.Context, dir, url string) error {
 	LogDebug(`Performing Git Clone from %q to %q`, url, dir)
 	cmd := exec.Command("git", "clone", url, dir)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("%s: %s", err.Error(), trim(out))
+	if out, err := CombinedOutput(ctx, cmd); err != nil {
+		return commandError("clone", err, out)
 	}
 	return nil
 }
 
-func GitCheckout(dir, ref string) error {
+func GitCheckout(ctx context.Context, dir, ref string) error {
 	LogDebug(`Performing Git Checkout in %q to %q`, dir, ref)
 	cmd := exec.Command("git", "checkout", ref)
 	cmd.Dir = dir
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("%s: %s", err.Error(), trim(out))
+	if out, err := CombinedOutput(ctx, cmd); err != nil {
+		return commandError("checkout", err, out)
 	}
 	return nil
 }
 
-func GitGetSHA1(dir string) (string, error) {
+func GitGetSHA1(ctx context.Context, dir string) (string, error) {
 	LogDebug(`Performing Git Rev-Parse in %q`, dir)
 	cmd := exec.Command("git", "rev-parse", "HEAD")
 	cmd.Dir = dir
-	out, err := cmd.CombinedOutput()
+	out, err := CombinedOutput(ctx, cmd)
 	if err != nil {
-		return "", fmt.Errorf("%s: %s", err.Error(), trim(out))
+		return "", commandError("rev-parse", err, out)
 	}
 	return trim(out), nil
 }
+
+func GitCloneMirror(ctx context.Context, dir, url string) error {
+	LogDebug(`Performing Git Mirror Clone from %q to %q`, url, dir)
+	cmd := exec.Command("git", "clone", "--mirror", url, dir)
+	if out, err := CombinedOutput(ctx, cmd); err != nil {
+		return commandError("clone", err, out)
+	}
+	return nil
+}
+
+func GitFetchMirror(ctx context.Context, dir string) error {
+	LogDebug(`Performing Git Fetch in mirror %q`, dir)
+	cmd := exec.Command("git", "fetch", "--prune", "origin")
+	cmd.Dir = dir
+	if out, err := CombinedOutput(ctx, cmd); err != nil {
+		return commandError("fetch", err, out)
+	}
+	return nil
+}
+
+// GitShallowFetch initialises a repository in dir and fetches just the commit
+// that ref points to from url, without any history. If sparseDir isn't empty,
+// only that directory of the commit is checked out and, where the server
+// supports it, only its files are downloaded.
+func GitShallowFetch(ctx context.Context, dir, url, ref, sparseDir string) error {
+	LogDebug(`Performing Git Shallow Fetch of %q from %q to %q`, ref, url, dir)
+	cmds := [][]string{
+		{"init", "--quiet"},
+		{"remote", "add", "origin", url},
+	}
+	if sparseDir != "" {
+		cmds = append(cmds,
+			[]string{"sparse-checkout", "set", sparseDir},
+			[]string{"fetch", "--depth", "1", "--filter=blob:none", "origin", ref})
+	} else {
+		cmds = append(cmds, []string{"fetch", "--depth", "1", "origin", ref})
+	}
+	cmds = append(cmds, []string{"checkout", "--quiet", "FETCH_HEAD"})
+	for _, args := range cmds {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := CombinedOutput(ctx, cmd); err != nil {
+			return commandError(args[0], err, out)
+		}
+	}
+	return nil
+}
+
+// IsGitSHA1 reports whether ref is a full SHA1 commit hash.
+func IsGitSHA1(ref string) bool {
+	if len(ref) != 40 {
+		return false
+	}
+	for _, c := range ref {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsImmutableGitRef reports whether ref always refers to the same commit,
+// i.e. whether it is a SHA1 or a fully qualified tag.
+func IsImmutableGitRef(ref string) bool {
+	return IsGitSHA1(ref) || strings.HasPrefix(ref, "refs/tags/")
+}
+
+// shortGitTag returns the fully qualified name of ref, if it's the short name
+// of a tag, and not also of a branch, in the repository at url, or "".
+func shortGitTag(ctx context.Context, url, ref string) string {
+	LogDebug(`Performing Git Ls-Remote of %q on %q`, ref, url)
+	tag, branch := "refs/tags/"+ref, "refs/heads/"+ref
+	cmd := exec.Command("git", "ls-remote", url, tag, branch)
+	out, err := CombinedOutput(ctx, cmd)
+	if err != nil {
+		LogDebug(`Could not look for tag %q in %q: %v`, ref, url, commandError("ls-remote", err, out))
+		return ""
+	}
+	var isTag bool
+	for _, line := range strings.Split(trim(out), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			if fields[1] == branch {
+				return ""
+			}
+			isTag = isTag || fields[1] == tag
+		}
+	}
+	if !isTag {
+		return ""
+	}
+	return tag
+}
+
+// GitResolveRef returns the SHA1 of the commit ref currently points to in the
+// repository at url, without cloning it.
+func GitResolveRef(ctx context.Context, url, ref string) (string, error) {
+	if IsGitSHA1(ref) {
+		return ref, nil
+	}
+	LogDebug(`Performing Git Ls-Remote of %q on %q`, ref, url)
+	cmd := exec.Command("git", "ls-remote", url, ref, ref+"^{}")
+	out, err := CombinedOutput(ctx, cmd)
+	if err != nil {
+		return "", commandError("ls-remote", err, out)
+	}
+	refs := make(map[string]string)
+	for _, line := range strings.Split(trim(out), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	// Prefer the peeled commit of annotated tags over the tag object itself.
+	for _, name := range []string{ref + "^{}", ref, "refs/heads/" + ref, "refs/tags/" + ref + "^{}", "refs/tags/" + ref} {
+		if sha, ok := refs[name]; ok {
+			return sha, nil
+		}
+	}
+	return "", fmt.Errorf("could not resolve %q in %q", ref, url)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// runGit runs a git command in dir for test setup, failing the test on error.
+func runGit(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=courier", "GIT_AUTHOR_EMAIL=courier@example.com",
+		"GIT_COMMITTER_NAME=courier", "GIT_COMMITTER_EMAIL=courier@example.com")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v: %s", args, err, out)
+	}
+	return trim(out)
+}
+
+// makeGitRepo creates a repository in a new temp dir with a single commit on
+// master containing files, and returns its directory.
+func makeGitRepo(t *testing.T, files map[string]string) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found on PATH")
+	}
+	dir, err := ioutil.TempDir("", "courier_test_repo_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, dir, "init", "-q")
+	runGit(t, dir, "checkout", "-q", "-b", "master")
+	commitFiles(t, dir, files)
+	return dir
+}
+
+// commitFiles writes files into the repository in dir and commits them,
+// returning the new commit's SHA1.
+func commitFiles(t *testing.T, dir string, files map[string]string) string {
+	for name, contents := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runGit(t, dir, "add", "-A")
+	runGit(t, dir, "commit", "-q", "-m", "commit")
+	return runGit(t, dir, "rev-parse", "HEAD")
+}
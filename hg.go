@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+)
+
+func init() {
+	RegisterBackend("hg", hgBackend{})
+}
+
+type HgDependency struct {
+	VCS  string `json:"vcs"` // XXX it doesn't make sense from a data model point of view to have this field. It's to help converting to JSON.
+	URL  string `json:"url"`
+	Rev  string `json:"rev"`
+	Dir  string `json:"dir"`
+	Hash string `json:"hash,omitempty"`
+	CommonKeys
+}
+
+func (d HgDependency) Kind() string        { return "hg" }
+func (d HgDependency) IgnoreDir() string   { return ".hg" }
+func (d HgDependency) DirToCopy() string   { return d.Dir }
+func (d HgDependency) Revision() string    { return d.Rev }
+func (d HgDependency) Immutable() bool     { return IsHgNode(d.Rev) }
+func (d HgDependency) ContentHash() string { return d.Hash }
+func (d HgDependency) Host() string        { return urlHost(d.URL) }
+func (d HgDependency) Source() string      { return d.URL }
+func (d HgDependency) SameSource(other Dependency) bool {
+	o, ok := other.(HgDependency)
+	return ok && o.URL == d.URL && o.Dir == d.Dir
+}
+func (d HgDependency) WithContentHash(hash string) Dependency {
+	d.Hash = hash
+	return d
+}
+func (d HgDependency) WithCommon(common CommonKeys) Dependency {
+	d.CommonKeys = common
+	return d
+}
+func (d HgDependency) WithDir(dir string) Dependency {
+	d.Dir = dir
+	return d
+}
+
+func LoadHgDependency(depMap map[string]string) (HgDependency, error) {
+	d := HgDependency{VCS: "hg"}
+	var ok bool
+	if d.URL, ok = depMap["url"]; !ok {
+		return HgDependency{}, errors.New("missing required key 'url'")
+	}
+	if d.Rev, ok = depMap["rev"]; !ok {
+		return HgDependency{}, errors.New("missing required key 'rev'")
+	}
+	if d.Dir, ok = depMap["dir"]; !ok {
+		return HgDependency{}, errors.New("missing required key 'dir'")
+	}
+	if err := checkDir(d.Dir); err != nil {
+		return HgDependency{}, err
+	}
+	d.Hash = depMap["hash"]
+	delete(depMap, "vcs")
+	delete(depMap, "url")
+	delete(depMap, "rev")
+	delete(depMap, "dir")
+	delete(depMap, "hash")
+	for k, v := range depMap {
+		LogWarn(`Ignoring unknown key value pair %q:%q`, k, v)
+	}
+	return d, nil
+}
+
+type hgBackend struct{}
+
+func (hgBackend) Load(ctx context.Context, depMap map[string]string) (Dependency, error) {
+	return LoadHgDependency(depMap)
+}
+
+func (hgBackend) Stage(ctx context.Context, dep Dependency, stagingDir string) (Dependency, error) {
+	hgDep := dep.(HgDependency)
+
+	// Clone into the staging dir.
+	if err := HgClone(ctx, stagingDir, hgDep.URL); err != nil {
+		return nil, err
+	}
+
+	// Update to the right changeset.
+	if err := HgUpdate(ctx, stagingDir, hgDep.Rev); err != nil {
+		return nil, err
+	}
+
+	// Get the changeset id so we can reproduce the exact version of the external.
+	node, err := HgGetChangeset(ctx, stagingDir)
+	if err != nil {
+		return nil, err
+	}
+	hgDep.Rev = node
+	return hgDep, nil
+}
+
+func (hgBackend) Resolve(ctx context.Context, dep Dependency) (string, error) {
+	hgDep := dep.(HgDependency)
+	return HgResolveRev(ctx, hgDep.URL, hgDep.Rev)
+}
+
+func HgClone(ctx context.Context, dir, url string) error {
+	LogDebug(`Performing Hg Clone from %q to %q`, url, dir)
+	cmd := exec.Command("hg", "--noninteractive", "clone", "--noupdate", url, dir)
+	if out, err := CombinedOutput(ctx, cmd); err != nil {
+		return commandError("clone", err, out)
+	}
+	return nil
+}
+
+func HgUpdate(ctx context.Context, dir, rev string) error {
+	LogDebug(`Performing Hg Update in %q to %q`, dir, rev)
+	cmd := exec.Command("hg", "--noninteractive", "update", "--rev", rev)
+	cmd.Dir = dir
+	if out, err := CombinedOutput(ctx, cmd); err != nil {
+		return commandError("update", err, out)
+	}
+	return nil
+}
+
+func HgGetChangeset(ctx context.Context, dir string) (string, error) {
+	LogDebug(`Performing Hg Log in %q`, dir)
+	cmd := exec.Command("hg", "--noninteractive", "log", "--rev", ".", "--template", "{node}")
+	cmd.Dir = dir
+	out, err := CombinedOutput(ctx, cmd)
+	if err != nil {
+		return "", commandError("log", err, out)
+	}
+	return trim(out), nil
+}
+
+// HgResolveRev returns the full changeset id that rev currently refers to in
+// the repository at url, without cloning it.
+func HgResolveRev(ctx context.Context, url, rev string) (string, error) {
+	if IsHgNode(rev) {
+		return rev, nil
+	}
+	LogDebug(`Performing Hg Identify of %q on %q`, rev, url)
+	cmd := exec.Command("hg", "--noninteractive", "identify", "--debug", "--id", "--rev", rev, url)
+	out, err := CombinedOutput(ctx, cmd)
+	if err != nil {
+		return "", commandError("identify", err, out)
+	}
+	return trim(out), nil
+}
+
+// IsHgNode reports whether rev is a full changeset id.
+func IsHgNode(rev string) bool {
+	// Changeset ids are SHA1 hashes, just like Git commit ids.
+	return IsGitSHA1(rev)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadHgDependency(t *testing.T) {
+	m, err := LoadManifest(context.Background(), []byte(`{"lib": {"vcs": "hg", "url": "https://example.com/lib", "rev": "default", "dir": "src"}}`))
+	if err != nil {
+		t.Fatalf("LoadManifest: %v", err)
+	}
+	expected := HgDependency{VCS: "hg", URL: "https://example.com/lib", Rev: "default", Dir: "src"}
+	if !reflect.DeepEqual(m["lib"], expected) {
+		t.Errorf("LoadManifest: got %v, expected %v", m["lib"], expected)
+	}
+	for _, js := range []string{
+		`{"lib": {"vcs": "hg", "url": "https://example.com/lib", "dir": ""}}`,
+		`{"lib": {"vcs": "hg", "url": "https://example.com/lib", "rev": "default", "dir": "src/../.."}}`,
+		`{"lib": {"vcs": "hg", "url": "https://example.com/lib", "rev": "default", "dir": "C:\\src"}}`,
+	} {
+		if _, err := LoadManifest(context.Background(), []byte(js)); err == nil {
+			t.Errorf("LoadManifest: %s: expected error", js)
+		}
+	}
+}
+
+func TestStageHgDependency(t *testing.T) {
+	if _, err := exec.LookPath("hg"); err != nil {
+		t.Skip("hg not found on PATH")
+	}
+	repo, err := ioutil.TempDir("", "courier_test_repo_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repo)
+	runHg := func(args ...string) string {
+		cmd := exec.Command("hg", append([]string{"--config", "ui.username=courier"}, args...)...)
+		cmd.Dir = repo
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("hg %v: %v: %s", args, err, out)
+		}
+		return trim(out)
+	}
+	runHg("init")
+	if err := os.MkdirAll(filepath.Join(repo, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(repo, "sub", "file1"), []byte("one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runHg("add")
+	runHg("commit", "-m", "commit")
+	node := runHg("log", "--rev", ".", "--template", "{node}")
+
+	staged, err := StageDependency(context.Background(), HgDependency{VCS: "hg", URL: repo, Rev: "default", Dir: "sub"})
+	if err != nil {
+		t.Fatalf("StageDependency: %v", err)
+	}
+	defer os.RemoveAll(staged.StagingDir)
+	if pin := staged.Pinned.(HgDependency).Rev; pin != node {
+		t.Errorf("StageDependency: pinned %q, expected %q", pin, node)
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(staged.StagingDir, "sub", "file1")); err != nil || string(buf) != "one" {
+		t.Errorf("StageDependency: sub/file1 = %q, %v; expected %q", buf, err, "one")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// jobs limits how many dependencies are staged or resolved at once. It is
+// set up from the command line.
+var jobs = newJobLimiter(0, 0)
+
+// A hostedDependency is obtained from a server, and how many are obtained from
+// the same server at once is limited.
+type hostedDependency interface {
+	Host() string
+}
+
+// DependencyHost returns the server dep is obtained from, or "" if it isn't
+// obtained from a server.
+func DependencyHost(dep Dependency) string {
+	if d, ok := dep.(hostedDependency); ok {
+		return d.Host()
+	}
+	return ""
+}
+
+// urlHost returns the host, and port if any, of rawurl, which may also be an
+// scp-like Git URL such as "git@github.com:optiver/courier.git". It returns ""
+// for file URLs and local paths.
+func urlHost(rawurl string) string {
+	if strings.Contains(rawurl, "://") {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return ""
+		}
+		return u.Host
+	}
+	i := strings.Index(rawurl, ":")
+	if i < 2 || strings.ContainsAny(rawurl[:i], `/\`) {
+		return "" // A local path, possibly starting with a Windows drive.
+	}
+	host := rawurl[:i]
+	if j := strings.LastIndex(host, "@"); j >= 0 {
+		host = host[j+1:]
+	}
+	return host
+}
+
+// jobLimiter limits how many jobs run at once, both overall and per host.
+type jobLimiter struct {
+	all     chan struct{}
+	perHost int
+
+	mu    sync.Mutex
+	hosts map[string]chan struct{}
+}
+
+// newJobLimiter returns a limiter allowing jobs at once, or as many as there
+// are CPUs if jobs < 1, and at most perHost of those for the same host, unless
+// perHost < 1.
+func newJobLimiter(jobs, perHost int) *jobLimiter {
+	if jobs < 1 {
+		jobs = runtime.NumCPU()
+	}
+	return &jobLimiter{
+		all:     make(chan struct{}, jobs),
+		perHost: perHost,
+		hosts:   make(map[string]chan struct{}),
+	}
+}
+
+// acquire blocks until a job for host may start. The returned function must
+// be called once the job is finished.
+func (l *jobLimiter) acquire(host string) (release func()) {
+	// Wait for the host before taking one of the overall slots, so jobs for a
+	// busy host don't hold up the others.
+	var hostSem chan struct{}
+	if host != "" && l.perHost > 0 {
+		l.mu.Lock()
+		hostSem = l.hosts[host]
+		if hostSem == nil {
+			hostSem = make(chan struct{}, l.perHost)
+			l.hosts[host] = hostSem
+		}
+		l.mu.Unlock()
+		hostSem <- struct{}{}
+	}
+	l.all <- struct{}{}
+	return func() {
+		<-l.all
+		if hostSem != nil {
+			<-hostSem
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestURLHost(t *testing.T) {
+	tests := []struct{ url, host string }{
+		{"https://github.com/optiver/courier.git", "github.com"},
+		{"ssh://git@git.example.com:2222/courier.git", "git.example.com:2222"},
+		{"git@github.com:optiver/courier.git", "github.com"},
+		{"svn://svn.example.com/repo/trunk", "svn.example.com"},
+		{"file:///tmp/repo", ""},
+		{"/tmp/repo", ""},
+		{`C:\repos\courier`, ""},
+		{"../repo:with:colons", ""},
+	}
+	for _, test := range tests {
+		if host := urlHost(test.url); host != test.host {
+			t.Errorf("urlHost(%q) = %q, expected %q", test.url, host, test.host)
+		}
+	}
+}
+
+func TestJobLimiter(t *testing.T) {
+	l := newJobLimiter(3, 1)
+
+	var mu sync.Mutex
+	running := make(map[string]int)
+	var total, maxTotal int
+	maxPerHost := make(map[string]int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		host := []string{"a", "b", "c", ""}[i%4]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release := l.acquire(host)
+			mu.Lock()
+			running[host]++
+			total++
+			if running[host] > maxPerHost[host] {
+				maxPerHost[host] = running[host]
+			}
+			if total > maxTotal {
+				maxTotal = total
+			}
+			mu.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			mu.Lock()
+			running[host]--
+			total--
+			mu.Unlock()
+			release()
+		}()
+	}
+	wg.Wait()
+
+	if maxTotal > 3 {
+		t.Errorf("jobLimiter: %d jobs ran at once, expected at most 3", maxTotal)
+	}
+	for _, host := range []string{"a", "b", "c"} {
+		if maxPerHost[host] > 1 {
+			t.Errorf("jobLimiter: %d jobs for host %q ran at once, expected at most 1", maxPerHost[host], host)
+		}
+	}
+}
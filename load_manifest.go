@@ -1,16 +1,29 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
 )
 
-func LoadManifest(raw []byte) (Manifest, error) {
+func LoadManifest(ctx context.Context, raw []byte) (Manifest, error) {
+	return loadManifest(ctx, raw, false)
+}
+
+// LoadPinnedManifest loads a pinned manifest, in which dependencies may also
+// have the key "mapped_from".
+func LoadPinnedManifest(ctx context.Context, raw []byte) (Manifest, error) {
+	return loadManifest(ctx, raw, true)
+}
+
+func loadManifest(ctx context.Context, raw []byte, pinned bool) (Manifest, error) {
 
 	LogDebug(`Loading Manifest %q`, string(raw))
 
-	var manifestMap map[string]map[string]string
+	var manifestMap map[string]map[string]json.RawMessage
 	err := json.Unmarshal(raw, &manifestMap)
 	if err != nil {
 		return Manifest{}, err
@@ -18,66 +31,106 @@ func LoadManifest(raw []byte) (Manifest, error) {
 
 	var manifest Manifest = make(map[string]Dependency)
 
-	for dir, dep := range manifestMap {
-		if vcs, ok := dep["vcs"]; !ok {
-			return Manifest{}, fmt.Errorf("missing required key 'vcs' in dependency '%s'", dir)
-		} else if vcs == "git" {
-			gitDep, err := LoadGitDependency(dep)
+	for dir, rawDep := range manifestMap {
+		if _, ok := rawDep["mappings"]; ok {
+			mapped, err := loadMappedDependencies(ctx, dir, rawDep)
 			if err != nil {
 				return Manifest{}, err
 			}
-			manifest[dir] = gitDep
-		} else if vcs == "svn" {
-			svnDep, err := LoadSVNDependency(dep)
-			if err != nil {
-				return Manifest{}, err
+			for mappedDir, dep := range mapped {
+				if _, ok := manifest[mappedDir]; ok {
+					return Manifest{}, fmt.Errorf("dependency '%s' is declared twice", mappedDir)
+				}
+				manifest[mappedDir] = dep
 			}
-			manifest[dir] = svnDep
-		} else {
-			return Manifest{}, fmt.Errorf("unknown dependency vcs '%s'", vcs)
+			continue
 		}
+		if _, ok := rawDep["mapped_from"]; ok && !pinned {
+			return Manifest{}, fmt.Errorf("key 'mapped_from' can only be used in pinned manifests in dependency '%s'", dir)
+		}
+		dep, err := loadDependency(ctx, dir, rawDep)
+		if err != nil {
+			return Manifest{}, err
+		}
+		if _, ok := manifest[dir]; ok {
+			return Manifest{}, fmt.Errorf("dependency '%s' is declared twice", dir)
+		}
+		manifest[dir] = dep
 	}
 
 	return manifest, nil
 }
 
-func LoadGitDependency(depMap map[string]string) (GitDependency, error) {
-	d := GitDependency{VCS: "git"}
-	var ok bool
-	if d.URL, ok = depMap["url"]; !ok {
-		return GitDependency{}, errors.New("missing required key 'url'")
+// loadDependency loads the dependency in dir from its keys, using the backend
+// its "vcs" names.
+func loadDependency(ctx context.Context, dir string, rawDep map[string]json.RawMessage) (Dependency, error) {
+	patches, err := LoadPatchSet(rawDep)
+	if err != nil {
+		return nil, fmt.Errorf("%v in dependency '%s'", err, dir)
+	}
+	filter, err := LoadPathFilter(rawDep)
+	if err != nil {
+		return nil, fmt.Errorf("%v in dependency '%s'", err, dir)
 	}
-	if d.Ref, ok = depMap["ref"]; !ok {
-		return GitDependency{}, errors.New("missing required key 'ref'")
+	depMap, err := scalarValues(rawDep)
+	if err != nil {
+		return nil, fmt.Errorf("%v in dependency '%s'", err, dir)
+	}
+	options, err := LoadFetchOptions(depMap)
+	if err != nil {
+		return nil, fmt.Errorf("%v in dependency '%s'", err, dir)
+	}
+	sharing := SharedCheckout{MappedFrom: depMap["mapped_from"]}
+	delete(depMap, "mapped_from")
+	vcs, ok := depMap["vcs"]
+	if !ok {
+		return nil, fmt.Errorf("missing required key 'vcs' in dependency '%s'", dir)
+	}
+	backend, err := LookupBackend(vcs)
+	if err != nil {
+		return nil, err
 	}
-	if d.Dir, ok = depMap["dir"]; !ok {
-		return GitDependency{}, errors.New("missing required key 'dir'")
+	if timeout, _ := options.Policy(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
-	delete(depMap, "vcs")
-	delete(depMap, "url")
-	delete(depMap, "ref")
-	delete(depMap, "dir")
-	for k, v := range depMap {
-		LogWarn(`Ignoring unknown key value pair %q:%q`, k, v)
+	dep, err := backend.Load(ctx, depMap)
+	if err != nil {
+		return nil, err
 	}
-	return d, nil
+	return dep.WithCommon(CommonKeys{options, patches, filter, sharing}), nil
 }
 
-func LoadSVNDependency(depMap map[string]string) (SVNDependency, error) {
-	d := SVNDependency{VCS: "svn"}
-	var ok bool
-	if d.URL, ok = depMap["url"]; !ok {
-		return SVNDependency{}, errors.New("missing required key 'url'")
-	}
-	if _, ok = depMap["rev"]; ok {
-		r := depMap["rev"]
-		d.Rev = &r
+// scalarValues converts the values of a dependency's keys to strings. Numbers
+// and booleans are kept as they were written, and null is "".
+func scalarValues(rawDep map[string]json.RawMessage) (map[string]string, error) {
+	depMap := make(map[string]string)
+	for k, raw := range rawDep {
+		var v interface{}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, err
+		}
+		switch v := v.(type) {
+		case string:
+			depMap[k] = v
+		case float64, bool:
+			depMap[k] = string(raw)
+		case nil:
+			depMap[k] = ""
+		default:
+			return nil, fmt.Errorf("value of key '%s' must be a string, number or boolean", k)
+		}
 	}
-	delete(depMap, "vcs")
-	delete(depMap, "url")
-	delete(depMap, "rev")
-	for k, v := range depMap {
-		LogWarn(`Ignoring unknown key value pair %q:%q`, k, v)
+	return depMap, nil
+}
+
+// checkDir checks the value of a dependency's "dir" key is a relative path
+// that stays inside what was obtained.
+func checkDir(dir string) error {
+	if p := path.Clean(dir); path.IsAbs(dir) || filepath.IsAbs(dir) || strings.ContainsAny(dir, `\:`) ||
+		p == ".." || strings.HasPrefix(p, "../") {
+		return fmt.Errorf("invalid value %q for key 'dir'", dir)
 	}
-	return d, nil
+	return nil
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	RegisterBackend("local", localBackend{})
+}
+
+type LocalDependency struct {
+	VCS  string `json:"vcs"` // XXX it doesn't make sense from a data model point of view to have this field. It's to help converting to JSON.
+	Path string `json:"path"`
+	Dir  string `json:"dir,omitempty"`
+	Hash string `json:"hash,omitempty"`
+
+	MetadataDir string `json:"ignore_dir,omitempty"` // If not ".git".
+
+	CommonKeys
+}
+
+func (d LocalDependency) Kind() string { return "local" }
+func (d LocalDependency) IgnoreDir() string {
+	if d.MetadataDir == "" {
+		return ".git"
+	}
+	return d.MetadataDir
+}
+func (d LocalDependency) DirToCopy() string   { return "" } // Only dir is staged.
+func (d LocalDependency) Revision() string    { return d.Hash }
+func (d LocalDependency) Immutable() bool     { return d.Hash != "" }
+func (d LocalDependency) ContentHash() string { return d.Hash }
+func (d LocalDependency) Source() string      { return d.Path }
+func (d LocalDependency) SameSource(other Dependency) bool {
+	o, ok := other.(LocalDependency)
+	return ok && o.Path == d.Path && o.Dir == d.Dir
+}
+func (d LocalDependency) WithContentHash(hash string) Dependency {
+	d.Hash = hash
+	return d
+}
+func (d LocalDependency) WithCommon(common CommonKeys) Dependency {
+	d.CommonKeys = common
+	return d
+}
+
+// src returns the directory the dependency is copied from.
+func (d LocalDependency) src() string {
+	return filepath.Join(d.Path, filepath.FromSlash(d.Dir))
+}
+
+func LoadLocalDependency(depMap map[string]string) (LocalDependency, error) {
+	d := LocalDependency{VCS: "local"}
+	var ok bool
+	if d.Path, ok = depMap["path"]; !ok {
+		return LocalDependency{}, errors.New("missing required key 'path'")
+	}
+	d.Dir = depMap["dir"]
+	if err := checkDir(d.Dir); err != nil {
+		return LocalDependency{}, err
+	}
+	d.Hash = depMap["hash"]
+	if ignore, ok := depMap["ignore_dir"]; ok {
+		if ignore == "" || ignore == "." || ignore == ".." || strings.ContainsAny(ignore, `/\`) {
+			return LocalDependency{}, fmt.Errorf("invalid value %q for key 'ignore_dir'", ignore)
+		}
+		d.MetadataDir = ignore
+	} else {
+		d.MetadataDir = detectMetadataDir(d.src())
+	}
+	delete(depMap, "vcs")
+	delete(depMap, "path")
+	delete(depMap, "dir")
+	delete(depMap, "hash")
+	delete(depMap, "ignore_dir")
+	for k, v := range depMap {
+		LogWarn(`Ignoring unknown key value pair %q:%q`, k, v)
+	}
+	return d, nil
+}
+
+// detectMetadataDir returns the dir of the Mercurial or SVN checkout in dir,
+// if it is one, or "" for the default of Git.
+func detectMetadataDir(dir string) string {
+	for _, name := range []string{".hg", ".svn"} {
+		if fi, err := os.Stat(filepath.Join(dir, name)); err == nil && fi.IsDir() {
+			return name
+		}
+	}
+	return ""
+}
+
+type localBackend struct{}
+
+func (localBackend) Load(ctx context.Context, depMap map[string]string) (Dependency, error) {
+	return LoadLocalDependency(depMap)
+}
+
+func (localBackend) Stage(ctx context.Context, dep Dependency, stagingDir string) (Dependency, error) {
+	localDep := dep.(LocalDependency)
+
+	LogWarn(`Pinning local path %q by its contents; the pin can't be reproduced on machines without it`, localDep.Path)
+
+	// Make sure the directory we want actually exists.
+	src := localDep.src()
+	fi, err := os.Stat(src)
+	if err != nil {
+		return nil, stepError("stat", err)
+	}
+	if !fi.IsDir() {
+		return nil, stepError("stat", fmt.Errorf("%q is not a dir", src))
+	}
+
+	// Copy it, so that it can't change under our feet. The pin is the content
+	// hash, which is recorded once staged.
+	if err := CopyDirContents(src, stagingDir, FileFilter{IgnoreDir: localDep.IgnoreDir()}); err != nil {
+		return nil, stepError("copy", err)
+	}
+	return localDep, nil
+}
+
+func (localBackend) Resolve(ctx context.Context, dep Dependency) (string, error) {
+	localDep := dep.(LocalDependency)
+	src := localDep.src()
+
+	// It's pinned by its contents once patched, so hash a patched copy.
+	if patches := localDep.Patching().Patches; len(patches) > 0 {
+		tmp, err := MakeTmpDir()
+		if err != nil {
+			return "", err
+		}
+		defer os.RemoveAll(tmp)
+		if err := CopyDirContents(src, tmp, FileFilter{IgnoreDir: localDep.IgnoreDir()}); err != nil {
+			return "", err
+		}
+		if err := ApplyPatches(tmp, patches); err != nil {
+			return "", err
+		}
+		src = tmp
+	}
+
+	hash, err := CreateDirHash(src, DependencyFiles(localDep))
+	if err != nil {
+		return "", err
+	}
+	return FormatDirHash(hash), nil
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -10,8 +10,11 @@ import (
 	"os/signal"
 	"path"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 const tagged = true
@@ -24,19 +27,45 @@ var cmdLineArgs struct {
 	colour          bool
 	reproduce       bool
 	forceCopy       bool
+	noCache         bool
+	shallow         bool
+	sparse          bool
 	primaryManifest string
 	pinnedManifest  string
+	cacheDir        string
+	output          string
+	jobs            int
+	jobsPerHost     int
+	allOrNothing    bool
+	timeout         time.Duration
+	retries         int
+	retryDelay      time.Duration
+	dryRun          bool
+	patch           bool
 }
 
+// exitInterrupted is the exit code when interrupted, as for shells.
+const exitInterrupted = 130
+
 func main() {
-	err := body()
-	if err != nil {
+	ctx, cancel := context.WithCancel(context.Background())
+	listenForSignals(cancel)
+	err := body(ctx)
+	if err != nil && ctx.Err() != nil {
+		LogError("Interrupted, stopped after cleaning up")
+		os.Exit(exitInterrupted)
+	} else if err != nil {
+		if stagingErr, ok := err.(*StagingError); ok {
+			_ = stagingErr.Report(cmdLineArgs.output) // The error is logged anyway.
+		} else {
+			EmitEvent(Event{Event: "error", Error: err.Error()})
+		}
 		LogError("%v", err)
 		os.Exit(1)
 	}
 }
 
-func body() error {
+func body(ctx context.Context) error {
 
 	// Set up command line args.
 	flag.BoolVar(&cmdLineArgs.help, "help", false, "show usage")
@@ -47,15 +76,53 @@ func body() error {
 	flag.BoolVar(&cmdLineArgs.forceCopy, "force-copy", false, "force copying dependency even if unchanged/identical")
 	flag.StringVar(&cmdLineArgs.primaryManifest, "primary-manifest", "deps.json", "location of the primary manifest")
 	flag.StringVar(&cmdLineArgs.pinnedManifest, "pinned-manifest", "pins.json", "location of the pinned manifest")
+	flag.StringVar(&cmdLineArgs.cacheDir, "cache-dir", DefaultCacheDir(), "location of the cache of Git mirrors")
+	flag.BoolVar(&cmdLineArgs.dryRun, "dry-run", false, "show what would be copied and pinned without changing anything")
+	flag.BoolVar(&cmdLineArgs.patch, "patch", false, "with diff, also show the unified diff of each changed text file")
+	flag.BoolVar(&cmdLineArgs.allOrNothing, "all-or-nothing", false, "if copying any dependency fails, put back all those already copied")
+	flag.BoolVar(&cmdLineArgs.noCache, "no-cache", false, "clone Git dependencies directly instead of through the cache")
+	flag.BoolVar(&cmdLineArgs.shallow, "shallow", true, "fetch only the needed commit of Git dependencies whose ref is a SHA1 or tag")
+	flag.BoolVar(&cmdLineArgs.sparse, "sparse", false, "when fetching only the needed commit, only check out the dependency's dir")
+	flag.IntVar(&cmdLineArgs.jobs, "jobs", runtime.NumCPU(), "number of dependencies to fetch at once")
+	flag.IntVar(&cmdLineArgs.jobsPerHost, "jobs-per-host", 4, "number of dependencies to fetch at once from the same server, 0 for no limit")
+	flag.DurationVar(&cmdLineArgs.timeout, "timeout", 0, "time allowed for obtaining each dependency, 0 for no limit")
+	flag.IntVar(&cmdLineArgs.retries, "retries", 2, "number of times to retry obtaining a dependency after a transient error")
+	flag.DurationVar(&cmdLineArgs.retryDelay, "retry-delay", 2*time.Second, "time to wait before the first retry, doubled for each further retry")
+	flag.StringVar(&cmdLineArgs.output, "output", "text", "format of command output: text or json")
 	flag.Parse()
 
+	// Commands may be followed by further flags.
+	command := flag.Arg(0)
+	if command != "" {
+		flag.CommandLine.Parse(flag.Args()[1:]) // Exits on error.
+	}
+
 	// Show help.
 	if cmdLineArgs.help {
-		fmt.Printf("Courier %s\nUsage:\n", version)
+		fmt.Printf("Courier %s\nUsage: courier [flags] [command [args]]\n\n", version)
+		fmt.Printf("Commands:\n")
+		fmt.Printf("  (none)  stage the dependencies and copy them into place\n")
+		fmt.Printf("  status  report drift between the manifests, upstream and the copied dependencies\n")
+		fmt.Printf("  verify  fail if any copied dependency differs from its pin\n")
+		fmt.Printf("  update  <dir>... re-pin only the given dependencies (globs allowed)\n")
+		fmt.Printf("  diff    [dir]... list the files of copied dependencies that differ from their pins\n")
+		fmt.Printf("  save-patch  <dir> [file] save the local edits of a copied dependency as one of its patches\n")
+		fmt.Printf("\nFlags:\n")
 		flag.PrintDefaults()
 		return nil
 	}
 
+	if cmdLineArgs.output != "text" && cmdLineArgs.output != "json" {
+		return fmt.Errorf("unknown output format %q", cmdLineArgs.output)
+	}
+	if cmdLineArgs.jobs < 1 || cmdLineArgs.jobsPerHost < 0 {
+		return fmt.Errorf("invalid number of jobs %d, %d per host", cmdLineArgs.jobs, cmdLineArgs.jobsPerHost)
+	}
+	if cmdLineArgs.timeout < 0 || cmdLineArgs.retries < 0 || cmdLineArgs.retryDelay < 0 {
+		return fmt.Errorf("timeout, retries and retry delay must not be negative")
+	}
+	jobs = newJobLimiter(cmdLineArgs.jobs, cmdLineArgs.jobsPerHost)
+
 	// Set up logging.
 	if err := SetupLogging(cmdLineArgs.quiet, cmdLineArgs.verbose); err != nil {
 		return err
@@ -68,102 +135,264 @@ func body() error {
 		LogWarn("\u001b[41mCourier version %s\u001b[0m", version)
 	}
 
-	listenForCtrlC()
+	// Set up the Git mirror cache.
+	if cmdLineArgs.noCache {
+		LogDebug("Not using a cache")
+	} else if cmdLineArgs.cacheDir == "" {
+		LogWarn("Could not determine a cache dir, not using a cache")
+	} else {
+		LogDebug("Using cache dir %q", cmdLineArgs.cacheDir)
+		gitCache = NewGitCache(cmdLineArgs.cacheDir)
+	}
+
+	switch command {
+	case "":
+		return fetchDependencies(ctx)
+	case "status":
+		return showStatus(ctx)
+	case "verify":
+		return verifyDependencies(ctx)
+	case "update":
+		return updateDependencies(ctx, flag.Args())
+	case "diff":
+		return diffDependencies(ctx, flag.Args())
+	case "save-patch":
+		return savePatch(ctx, flag.Args())
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
+
+// fetchDependencies stages the dependencies, copies them into place and pins
+// them.
+func fetchDependencies(ctx context.Context) error {
+	start := time.Now()
 
-	// Determine which manifest to read from.
-	var manifestFile string
+	// Get the manifest, the pinned one if reproducing.
+	var m Manifest
+	var err error
 	if cmdLineArgs.reproduce {
-		manifestFile = cmdLineArgs.pinnedManifest
+		m, err = readPinnedManifest(ctx)
 	} else {
-		manifestFile = cmdLineArgs.primaryManifest
+		m, err = readManifest(ctx, cmdLineArgs.primaryManifest)
 	}
-
-	// Get the manifest.
-	LogInfo("Using manifest %q", manifestFile)
-	buf, err := ioutil.ReadFile(manifestFile)
 	if err != nil {
 		return err
 	}
-	m, err := LoadManifest(buf)
-	if err != nil {
-		enrErr := enrichJSONError(err, string(buf))
-		return enrErr
+
+	// Pins made before content hashes were recorded can't be verified.
+	if cmdLineArgs.reproduce {
+		for dir, dep := range m {
+			if dep.ContentHash() == "" {
+				LogWarn(`Dependency %q has no pinned content hash, so its contents can't be verified`, dir)
+			}
+		}
+	}
+
+	// Get the existing pins.
+	pinned := m
+	if !cmdLineArgs.reproduce {
+		pinned, err = readPinnedManifest(ctx)
+		if os.IsNotExist(err) {
+			pinned = make(map[string]Dependency)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	// Dependencies that are already in place at their pinned revision don't
+	// need staging.
+	var reused map[string]StagedDependency
+	if !cmdLineArgs.forceCopy {
+		if m, reused, err = ReusePins(m, pinned); err != nil {
+			return err
+		}
 	}
 
 	// Stage the dependencies.
-	stagedDeps, err := StageDependencies(m)
+	stagedDeps, err := StageDependencies(ctx, m)
 	if err != nil {
 		return err
 	}
+	for dir, stagedDep := range reused {
+		stagedDeps[dir] = stagedDep
+	}
 
 	// Clean up the staged dependencies when we return.
-	defer func() {
-		for _, stagedDep := range stagedDeps {
-			_ = os.RemoveAll(stagedDep.StagingDir) // If we can't remove... then there's not much we can do.
-		}
-	}()
+	defer removeStaged(stagedDeps)
 
-	// Copy the dependencies.
-	for dir, stagedDep := range stagedDeps {
-		src := path.Join(stagedDep.StagingDir, stagedDep.Pinned.DirToCopy())
+	// Show what would change instead of changing it.
+	if cmdLineArgs.dryRun {
+		return showChanges(stagedDeps, pinned)
+	}
 
-		if cmdLineArgs.forceCopy {
-			LogInfo(`Copying dependency %q (forced)`, dir)
-			if err := CopyDirContents(src, dir, stagedDep.Pinned.IgnoreDir()); err != nil {
-				return err
-			}
-		} else {
-			// Calculate source and destination hashes; skip copying if equal
-			srcHash, err := CreateDirHash(src, stagedDep.Pinned.IgnoreDir())
-			if err != nil {
-				return err
-			}
-			dstHash, err := CreateDirHash(dir, stagedDep.Pinned.IgnoreDir())
-			if err != nil && !os.IsNotExist(err) {
-				return err
-			}
-			equalDirs := bytes.Equal(srcHash, dstHash)
-			if equalDirs {
-				LogInfo(`Skipping copying dependency %q (unchanged)`, dir)
-			} else {
-				LogDebug(`Src hash: %x, Dst hash: %x`, srcHash, dstHash)
-				LogInfo(`Copying dependency %q`, dir)
-				if err := CopyDirContents(src, dir, stagedDep.Pinned.IgnoreDir()); err != nil {
-					return err
-				}
-			}
-		}
+	// Copy the dependencies.
+	if err := copyDependencies(ctx, stagedDeps); err != nil {
+		return err
 	}
 
 	// Save the pinned manifest to file.
 	if !cmdLineArgs.reproduce {
-		LogInfo("Saving pinned manifest to %q", cmdLineArgs.pinnedManifest)
 		var pinned Manifest = make(map[string]Dependency)
 		for dir, stagedDep := range stagedDeps {
 			pinned[dir] = stagedDep.Pinned
 		}
-		if raw, err := json.MarshalIndent(pinned, "", "\t"); err != nil {
-			return err
-		} else if err := ioutil.WriteFile(cmdLineArgs.pinnedManifest, append(raw, '\n'), 0644); err != nil {
+		if err := savePinnedManifest(pinned); err != nil {
 			return err
 		}
 	}
 
 	LogInfo("Finished!")
+	EmitEvent(Event{Event: "finished", DurationMS: msSince(start)})
 
 	return nil
 }
 
-func listenForCtrlC() {
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, os.Kill)
+// copyDependencies copies each staged dependency into place, unless it's
+// unchanged. With --all-or-nothing, if any copy fails then every dependency
+// already copied is put back as it was.
+func copyDependencies(ctx context.Context, stagedDeps map[string]StagedDependency) (err error) {
+
+	// Keep what was in place of each copied dependency until we're done.
+	backups := make(map[string]string)
+	defer func() {
+		for dir, backup := range backups {
+			if err != nil && cmdLineArgs.allOrNothing {
+				LogInfo(`Restoring dependency %q`, dir)
+				if restoreErr := RestoreDir(dir, backup); restoreErr != nil {
+					LogWarn(`Could not restore dependency %q from %q: %v`, dir, backup, restoreErr)
+				} else {
+					EmitEvent(Event{Event: "restored", Dir: dir})
+				}
+			} else if backup != "" {
+				_ = os.RemoveAll(backup) // If this errors out, there's not much we can do.
+			}
+		}
+	}()
+	replace := func(src, dir string, pin Dependency) error {
+		start := time.Now()
+		backup, err := ReplaceDirContents(src, dir, DependencyFiles(pin))
+		if err != nil {
+			EmitEvent(Event{Event: "error", Dir: dir, VCS: pin.Kind(), Step: "copy", Error: err.Error()})
+			return err
+		}
+		backups[dir] = backup
+		EmitEvent(Event{Event: "copied", Dir: dir, VCS: pin.Kind(), Revision: pin.Revision(), DurationMS: msSince(start)})
+		return nil
+	}
+
+	// Copy in a fixed order, so what's copied before any failure is too.
+	var dirs []string
+	for dir := range stagedDeps {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		stagedDep := stagedDeps[dir]
+
+		// Stop between dependencies, so none is left half copied.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Reused pins were already reported as skipped.
+		if stagedDep.Unchanged {
+			continue
+		}
+		changed, err := needsCopy(dir, stagedDep)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			LogInfo(`Skipping copying dependency %q (unchanged)`, dir)
+			EmitEvent(Event{Event: "skipped", Dir: dir, VCS: stagedDep.Pinned.Kind(), Reason: "unchanged"})
+			continue
+		}
+		if cmdLineArgs.forceCopy {
+			LogInfo(`Copying dependency %q (forced)`, dir)
+		} else {
+			LogInfo(`Copying dependency %q`, dir)
+		}
+		src := path.Join(stagedDep.StagingDir, stagedDep.Pinned.DirToCopy())
+		if err := replace(src, dir, stagedDep.Pinned); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// needsCopy reports whether the staged dependency needs copying into dir,
+// because it's not already there or copying is forced.
+func needsCopy(dir string, stagedDep StagedDependency) (bool, error) {
+	if stagedDep.Unchanged {
+		return false, nil
+	}
+	if cmdLineArgs.forceCopy {
+		return true, nil
+	}
+
+	// Calculate the destination hash; skip copying if equal to the source.
+	srcHash := stagedDep.Pinned.ContentHash()
+	dstHash, err := CreateDirHash(dir, DependencyFiles(stagedDep.Pinned))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	LogDebug(`Src hash: %s, Dst hash: %s`, srcHash, FormatDirHash(dstHash))
+	return srcHash != FormatDirHash(dstHash), nil
+}
+
+// savePinnedManifest writes pinned to the pinned manifest file.
+func savePinnedManifest(pinned Manifest) error {
+	LogInfo("Saving pinned manifest to %q", cmdLineArgs.pinnedManifest)
+	if raw, err := json.MarshalIndent(pinned, "", "\t"); err != nil {
+		return err
+	} else if err := ioutil.WriteFile(cmdLineArgs.pinnedManifest, append(raw, '\n'), 0644); err != nil {
+		return err
+	}
+	for dir, pin := range pinned {
+		EmitEvent(Event{Event: "pinned", Dir: dir, VCS: pin.Kind(), Revision: pin.Revision(), Hash: pin.ContentHash()})
+	}
+	return nil
+}
+
+// listenForSignals calls cancel when interrupted or terminated. A second
+// signal kills any running commands and exits straight away.
+func listenForSignals(cancel context.CancelFunc) {
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		sig := <-sigCh
-		LogInfo("Received signal %s, panicking now!", sig)
-		panic(fmt.Sprintf("%s", sig))
+		LogWarn("Received signal %s, cancelling", sig)
+		cancel()
+		sig = <-sigCh
+		LogError("Received signal %s again, exiting without cleaning up", sig)
+		KillRunningCommands()
+		os.Exit(exitInterrupted)
 	}()
 }
 
+func readManifest(ctx context.Context, manifestFile string) (Manifest, error) {
+	return readManifestWith(ctx, manifestFile, LoadManifest)
+}
+
+func readPinnedManifest(ctx context.Context) (Manifest, error) {
+	return readManifestWith(ctx, cmdLineArgs.pinnedManifest, LoadPinnedManifest)
+}
+
+func readManifestWith(ctx context.Context, manifestFile string, load func(context.Context, []byte) (Manifest, error)) (Manifest, error) {
+	LogInfo("Using manifest %q", manifestFile)
+	buf, err := ioutil.ReadFile(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+	m, err := load(ctx, buf)
+	if err != nil {
+		return nil, enrichJSONError(err, string(buf))
+	}
+	return m, nil
+}
+
 func enrichJSONError(err error, js string) error {
 	if s, ok := err.(*json.SyntaxError); ok {
 		line, pos, desc := findLineAndPos(s, js)
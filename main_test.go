@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyDependenciesAllOrNothing(t *testing.T) {
+	oldArgs := cmdLineArgs
+	defer func() { cmdLineArgs = oldArgs }()
+	cmdLineArgs.allOrNothing = true
+
+	tmp, err := ioutil.TempDir("", "courier_test_copy_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	deps := filepath.Join(tmp, "deps")
+	writeFiles(t, filepath.Join(deps, "a"), map[string]string{"file": "old a"})
+	writeFiles(t, filepath.Join(tmp, "stage_a"), map[string]string{"file": "new a"})
+	writeFiles(t, filepath.Join(tmp, "stage_b"), map[string]string{"file": "new b"})
+
+	// Copying "c" fails, as what was staged is gone, after "a" and "b" are
+	// copied.
+	pin := LocalDependency{VCS: "local", Hash: "sha256:00"}
+	stagedDeps := map[string]StagedDependency{
+		filepath.Join(deps, "a"): {StagingDir: filepath.Join(tmp, "stage_a"), Pinned: pin},
+		filepath.Join(deps, "b"): {StagingDir: filepath.Join(tmp, "stage_b"), Pinned: pin},
+		filepath.Join(deps, "c"): {StagingDir: filepath.Join(tmp, "stage_c"), Pinned: pin},
+	}
+	if err := copyDependencies(context.Background(), stagedDeps); err == nil {
+		t.Fatalf("copyDependencies: expected error")
+	}
+
+	if buf, err := ioutil.ReadFile(filepath.Join(deps, "a", "file")); err != nil || string(buf) != "old a" {
+		t.Errorf("copyDependencies: a/file = %q, %v; expected %q restored", buf, err, "old a")
+	}
+	infos, err := ioutil.ReadDir(deps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if info.Name() != "a" {
+			t.Errorf("copyDependencies: %q left next to the dependencies", info.Name())
+		}
+	}
+}
+
+func TestCopyDependenciesUnchanged(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(output string) { eventOutput, cmdLineArgs.output = os.Stdout, output }(cmdLineArgs.output)
+	eventOutput, cmdLineArgs.output = &buf, "json"
+
+	stagedDeps := map[string]StagedDependency{"dep": {Pinned: LocalDependency{VCS: "local"}, Unchanged: true}}
+	if err := copyDependencies(context.Background(), stagedDeps); err != nil {
+		t.Fatalf("copyDependencies: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("copyDependencies: got events %s, expected none for a reused pin", buf.Bytes())
+	}
+}
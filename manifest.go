@@ -3,25 +3,76 @@ package main
 type Manifest map[string]Dependency
 
 type Dependency interface {
+	// Kind returns the value of "vcs" the dependency's backend is registered
+	// under.
+	Kind() string
+
 	IgnoreDir() string
 	DirToCopy() string
+	Revision() string
+
+	// Immutable reports whether the dependency always refers to the same
+	// revision of its source.
+	Immutable() bool
+
+	// SameSource reports whether other has the same source as the dependency,
+	// i.e. whether only the revision may differ between them.
+	SameSource(other Dependency) bool
+
+	// ContentHash returns the pinned hash of the dependency's contents, or ""
+	// if it hasn't been pinned.
+	ContentHash() string
+	WithContentHash(hash string) Dependency
+
+	// Options returns how the dependency should be obtained.
+	Options() FetchOptions
+
+	// Patching returns the patches to apply to the dependency once obtained.
+	Patching() PatchSet
+
+	// Filtering returns which of the dependency's files are copied.
+	Filtering() PathFilter
+
+	// Sharing returns which entry of the manifest the dependency was mapped
+	// from, sharing its checkout with the others mapped from it.
+	Sharing() SharedCheckout
+
+	// Common returns the keys any dependency may have, and WithCommon a copy
+	// of the dependency with them replaced.
+	Common() CommonKeys
+	WithCommon(common CommonKeys) Dependency
 }
 
-type GitDependency struct {
-	VCS string `json:"vcs"` // XXX it doesn't make sense from a data model point of view to have this field. It's to help converting to JSON.
-	URL string `json:"url"`
-	Ref string `json:"ref"`
-	Dir string `json:"dir"`
+// CommonKeys are the keys any dependency may have, whatever its vcs. They're
+// loaded by LoadManifest rather than by the dependency's backend, and embedded
+// in each kind of dependency.
+type CommonKeys struct {
+	FetchOptions
+	PatchSet
+	PathFilter
+	SharedCheckout
 }
 
-func (d GitDependency) IgnoreDir() string { return ".git" }
-func (d GitDependency) DirToCopy() string { return d.Dir }
+func (c CommonKeys) Common() CommonKeys { return c }
 
-type SVNDependency struct {
-	VCS string  `json:"vcs"` // XXX it doesn't make sense from a data model point of view to have this field. It's to help converting to JSON.
-	URL string  `json:"url"`
-	Rev *string `json:"rev,omitempty"`
+// A taggedDependency can say which tag its pin was made from, if any.
+type taggedDependency interface {
+	PinnedFrom() string
 }
 
-func (d SVNDependency) IgnoreDir() string { return ".svn" }
-func (d SVNDependency) DirToCopy() string { return "" } // Copy the whole thing.
+// PinnedAt reports whether pin was made at the revision dep refers to, either
+// because it has that revision or was made from that tag.
+func PinnedAt(dep, pin Dependency) bool {
+	if dep.Revision() == pin.Revision() {
+		return true
+	}
+	p, ok := pin.(taggedDependency)
+	return ok && p.PinnedFrom() != "" && p.PinnedFrom() == dep.Revision()
+}
+
+// PinMatches reports whether pin was produced from a dependency with the same
+// source, patches and filter as dep.
+func PinMatches(dep, pin Dependency) bool {
+	return dep.Kind() == pin.Kind() && dep.SameSource(pin) &&
+		SamePatches(dep.Patching(), pin.Patching()) && SameFilter(dep.Filtering(), pin.Filtering())
+}
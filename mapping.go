@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// SharedCheckout records the entry of the manifest, declaring several mappings
+// of dirs to destinations, that a dependency was mapped from. Dependencies
+// mapped from the same entry are staged from one checkout, and so pinned at the
+// same revision.
+type SharedCheckout struct {
+	MappedFrom string `json:"mapped_from,omitempty"`
+}
+
+func (s SharedCheckout) Sharing() SharedCheckout { return s }
+
+// A mappableDependency can be mapped from an entry with "mappings", by copying
+// it with each of the entry's dirs.
+type mappableDependency interface {
+	WithDir(dir string) Dependency
+}
+
+// loadMappedDependencies loads a dependency for each of the mappings of the
+// entry of a manifest with the given key, in the destination relative to it.
+func loadMappedDependencies(ctx context.Context, key string, rawDep map[string]json.RawMessage) (Manifest, error) {
+	var mappings map[string]string
+	if err := json.Unmarshal(rawDep["mappings"], &mappings); err != nil || len(mappings) == 0 {
+		return nil, fmt.Errorf("value of key 'mappings' must be an object of dirs to destinations in dependency '%s'", key)
+	}
+	for _, k := range []string{"dir", "patches", "mapped_from"} {
+		if _, ok := rawDep[k]; ok {
+			return nil, fmt.Errorf("key '%s' can't be used with 'mappings' in dependency '%s'", k, key)
+		}
+	}
+
+	var deps Manifest = make(map[string]Dependency)
+	for dir, dst := range mappings {
+		if clean := path.Clean(dst); dst == "" || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return nil, fmt.Errorf("invalid destination %q of mapping %q in dependency '%s'", dst, dir, key)
+		}
+		// Copying one into the other would move the other out of the way.
+		for otherDir, other := range mappings {
+			if otherDir != dir && isWithin(path.Clean(dst), path.Clean(other)) {
+				return nil, fmt.Errorf("destination %q of mapping %q is within destination %q of mapping %q in dependency '%s'", dst, dir, other, otherDir, key)
+			}
+		}
+		mappedDep := make(map[string]json.RawMessage)
+		for k, v := range rawDep {
+			if k != "mappings" {
+				mappedDep[k] = v
+			}
+		}
+		mappedDep["dir"], _ = json.Marshal(dir)         // Can't fail for a string.
+		mappedDep["mapped_from"], _ = json.Marshal(key) // Nor here.
+		dep, err := loadDependency(ctx, key, mappedDep)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := dep.(mappableDependency); !ok {
+			return nil, fmt.Errorf("vcs '%s' doesn't support 'mappings' in dependency '%s'", dep.Kind(), key)
+		}
+		deps[path.Join(key, dst)] = dep
+	}
+	return deps, nil
+}
+
+// isWithin reports whether the clean relative path p is dir or inside it.
+func isWithin(p, dir string) bool {
+	return dir == "." || p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// groupMapped splits m into the groups of dependencies to stage together:
+// those mapped from the same entry, by its key, and each other dependency on
+// its own, by its dir.
+func groupMapped(m Manifest) map[string]Manifest {
+	groups := make(map[string]Manifest)
+	for dir, dep := range m {
+		name := dir
+		if from := dep.Sharing().MappedFrom; from != "" {
+			name = from
+		}
+		if groups[name] == nil {
+			groups[name] = make(map[string]Dependency)
+		}
+		groups[name][dir] = dep
+	}
+	return groups
+}
+
+// AddMappedSiblings returns selected, along with every dependency in m mapped
+// from the same entry as one selected.
+func AddMappedSiblings(m, selected Manifest) Manifest {
+	var withSiblings Manifest = make(map[string]Dependency)
+	for dir, dep := range selected {
+		withSiblings[dir] = dep
+		if from := dep.Sharing().MappedFrom; from != "" {
+			for siblingDir, sibling := range m {
+				if sibling.Sharing().MappedFrom == from {
+					withSiblings[siblingDir] = sibling
+				}
+			}
+		}
+	}
+	return withSiblings
+}
+
+// stageGroup stages a group of dependencies from groupMapped.
+func stageGroup(ctx context.Context, group Manifest) (map[string]StagedDependency, error) {
+	if len(group) == 1 {
+		for dir, dep := range group {
+			staged, err := StageDependency(ctx, dep)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]StagedDependency{dir: staged}, nil
+		}
+	}
+	return StageMappedDependencies(ctx, group)
+}
+
+// StageMappedDependencies obtains dependencies mapped from the same entry,
+// which differ only in their dirs, into one new staging dir, and pins each.
+func StageMappedDependencies(ctx context.Context, deps Manifest) (staged map[string]StagedDependency, err error) {
+
+	var dirs []string
+	for dir := range deps {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	first := deps[dirs[0]]
+	if _, ok := first.(mappableDependency); !ok {
+		err = stepError("load", fmt.Errorf("vcs '%s' doesn't support 'mappings'", first.Kind()))
+		return
+	}
+	for _, dir := range dirs[1:] {
+		dep := deps[dir]
+		if dep.Kind() != first.Kind() || !dep.SameSource(first.(mappableDependency).WithDir(dep.DirToCopy())) || dep.Revision() != first.Revision() {
+			err = stepError("load", fmt.Errorf("dependencies mapped from %q differ other than in their dirs", first.Sharing().MappedFrom))
+			return
+		}
+	}
+
+	var backend Backend
+	backend, err = LookupBackend(first.Kind())
+	if err != nil {
+		err = stepError("load", err)
+		return
+	}
+
+	// Get a temp dir.
+	var stagingDir string
+	stagingDir, err = MakeTmpDir()
+	if err != nil {
+		return
+	}
+
+	// Clean up on exit if something went wrong.
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(stagingDir) // If this errors out, there's not much we can do.
+			staged = nil
+		}
+	}()
+
+	// Obtain the checkout, once.
+	var pin Dependency
+	pin, err = backend.Stage(ctx, first, stagingDir)
+	if err != nil {
+		err = stepError("stage", err)
+		return
+	}
+
+	// Pin each dependency at the same revision, from its own dir.
+	staged = make(map[string]StagedDependency)
+	for _, dir := range dirs {
+		dep := deps[dir]
+		mappedPin := pin.(mappableDependency).WithDir(dep.DirToCopy())
+		if staged[dir], err = finishStaging(dep, mappedPin, stagingDir); err != nil {
+			return
+		}
+	}
+	return
+}
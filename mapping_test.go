@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLoadMappedDependencies(t *testing.T) {
+	m, err := LoadManifest(context.Background(), []byte(`{"vendor/lib": {"vcs": "git", "url": "https://example.com/lib", "ref": "master",
+		"mappings": {"include": "include", "src/core": "core"}}}`))
+	if err != nil {
+		t.Fatalf("LoadManifest: %v", err)
+	}
+	sharing := SharedCheckout{MappedFrom: "vendor/lib"}
+	expected := Manifest{
+		"vendor/lib/include": GitDependency{VCS: "git", URL: "https://example.com/lib", Ref: "master", Dir: "include", CommonKeys: CommonKeys{SharedCheckout: sharing}},
+		"vendor/lib/core":    GitDependency{VCS: "git", URL: "https://example.com/lib", Ref: "master", Dir: "src/core", CommonKeys: CommonKeys{SharedCheckout: sharing}},
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("LoadManifest: got %v, expected %v", m, expected)
+	}
+
+	for _, js := range []string{
+		`{"lib": {"vcs": "git", "url": "https://example.com/lib", "ref": "master", "dir": "", "mappings": {"a": "a"}}}`,
+		`{"lib": {"vcs": "git", "url": "https://example.com/lib", "ref": "master", "mappings": {"a": "../a"}}}`,
+		`{"lib": {"vcs": "git", "url": "https://example.com/lib", "ref": "master", "mappings": {}}}`,
+		`{"lib": {"vcs": "git", "url": "https://example.com/lib", "ref": "master", "mappings": {"include": ".", "src": "src"}}}`,
+		`{"lib": {"vcs": "git", "url": "https://example.com/lib", "ref": "master", "mappings": {"include": "a/b", "src": "a"}}}`,
+		`{"lib": {"vcs": "git", "url": "https://example.com/lib", "ref": "master", "mappings": {"include": "a", "src": "./a"}}}`,
+		`{"lib": {"vcs": "git", "url": "https://example.com/lib", "ref": "master", "mappings": {"a": "a"}},
+		  "lib/a": {"vcs": "git", "url": "https://example.com/lib", "ref": "master", "dir": "a"}}`,
+		`{"lib/a": {"vcs": "git", "url": "https://example.com/lib", "ref": "master", "dir": "a", "mapped_from": "lib"}}`,
+	} {
+		if _, err := LoadManifest(context.Background(), []byte(js)); err == nil {
+			t.Errorf("LoadManifest: %s: expected error", js)
+		}
+	}
+
+	pinned, err := LoadPinnedManifest(context.Background(), []byte(`{"lib/a": {"vcs": "git", "url": "https://example.com/lib", "ref": "master", "dir": "a", "mapped_from": "lib"}}`))
+	if err != nil {
+		t.Fatalf("LoadPinnedManifest: %v", err)
+	}
+	if from := pinned["lib/a"].Sharing().MappedFrom; from != "lib" {
+		t.Errorf("LoadPinnedManifest: mapped from %q, expected %q", from, "lib")
+	}
+}
+
+func TestStageMappedDependencies(t *testing.T) {
+	repo := makeGitRepo(t, map[string]string{"include/a.h": "header", "src/core/a.c": "source"})
+	defer os.RemoveAll(repo)
+	sha := runGit(t, repo, "rev-parse", "HEAD")
+
+	oldArgs, oldCache := cmdLineArgs, gitCache
+	defer func() { cmdLineArgs, gitCache = oldArgs, oldCache }()
+	cmdLineArgs.shallow, cmdLineArgs.sparse, gitCache = true, true, nil
+
+	sharing := SharedCheckout{MappedFrom: "lib"}
+	url := "file://" + filepath.ToSlash(repo)
+	m := Manifest{
+		"lib/include": GitDependency{VCS: "git", URL: url, Ref: sha, Dir: "include", CommonKeys: CommonKeys{SharedCheckout: sharing}},
+		"lib/core":    GitDependency{VCS: "git", URL: url, Ref: sha, Dir: "src/core", CommonKeys: CommonKeys{SharedCheckout: sharing}},
+	}
+	stagedDeps, err := StageDependencies(context.Background(), m)
+	if err != nil {
+		t.Fatalf("StageDependencies: %v", err)
+	}
+	defer os.RemoveAll(stagedDeps["lib/core"].StagingDir)
+
+	include, core := stagedDeps["lib/include"], stagedDeps["lib/core"]
+	if include.StagingDir != core.StagingDir {
+		t.Errorf("StageDependencies: staged into %q and %q, expected one checkout", include.StagingDir, core.StagingDir)
+	}
+	for dir, expected := range map[string]string{"lib/include": "include", "lib/core": "src/core"} {
+		pin := stagedDeps[dir].Pinned.(GitDependency)
+		if pin.Ref != sha || pin.Dir != expected || pin.MappedFrom != "lib" {
+			t.Errorf("StageDependencies: %q: pinned %+v", dir, pin)
+		}
+	}
+	if include.Pinned.ContentHash() == core.Pinned.ContentHash() {
+		t.Errorf("StageDependencies: expected each dir to be hashed on its own")
+	}
+}
+
+func TestStageMappedDependenciesDifferentSources(t *testing.T) {
+	sharing := SharedCheckout{MappedFrom: "lib"}
+	m := Manifest{
+		"lib/a": GitDependency{VCS: "git", URL: "https://example.com/lib", Ref: "master", Dir: "a", CommonKeys: CommonKeys{SharedCheckout: sharing}},
+		"lib/b": GitDependency{VCS: "git", URL: "https://example.com/other", Ref: "master", Dir: "b", CommonKeys: CommonKeys{SharedCheckout: sharing}},
+	}
+	if _, err := StageMappedDependencies(context.Background(), m); err == nil {
+		t.Errorf("StageMappedDependencies: expected error for dependencies from different sources")
+	}
+}
+
+func TestStageMappedArchiveDependencies(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "courier_test_archives_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	archive := makeTarGz(t, archiveTestFiles)
+	p := filepath.Join(tmp, "lib.tgz")
+	if err := ioutil.WriteFile(p, archive, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The whole archive, with no dir, can be mapped along with a dir in it.
+	m, err := LoadManifest(context.Background(), []byte(`{"lib": {"vcs": "archive", "url": "file://`+filepath.ToSlash(p)+`",
+		"sha256": "`+fmt.Sprintf("%x", sha256.Sum256(archive))+`", "strip_components": 1, "mappings": {"": "all", "include": "include"}}}`))
+	if err != nil {
+		t.Fatalf("LoadManifest: %v", err)
+	}
+	stagedDeps, err := StageDependencies(context.Background(), m)
+	if err != nil {
+		t.Fatalf("StageDependencies: %v", err)
+	}
+	defer os.RemoveAll(stagedDeps["lib/all"].StagingDir)
+	for dir, expected := range map[string]string{"lib/all": "", "lib/include": "include"} {
+		if pin := stagedDeps[dir].Pinned.(ArchiveDependency); pin.Dir != expected || pin.MappedFrom != "lib" {
+			t.Errorf("StageDependencies: %q: pinned %+v", dir, pin)
+		}
+	}
+}
+
+func TestAddMappedSiblings(t *testing.T) {
+	sharing := SharedCheckout{MappedFrom: "lib"}
+	m := Manifest{
+		"lib/a": GitDependency{VCS: "git", Dir: "a", CommonKeys: CommonKeys{SharedCheckout: sharing}},
+		"lib/b": GitDependency{VCS: "git", Dir: "b", CommonKeys: CommonKeys{SharedCheckout: sharing}},
+		"other": GitDependency{VCS: "git"},
+	}
+	var dirs []string
+	for dir := range AddMappedSiblings(m, Manifest{"lib/a": m["lib/a"]}) {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	if expected := []string{"lib/a", "lib/b"}; !reflect.DeepEqual(dirs, expected) {
+		t.Errorf("AddMappedSiblings: got %q, expected %q", dirs, expected)
+	}
+}
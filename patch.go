@@ -0,0 +1,340 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PatchSet lists the patches to apply to a dependency once obtained, and, once
+// pinned, their hash.
+type PatchSet struct {
+	Patches     []string `json:"patches,omitempty"` // Unified diffs, applied with -p1 from the dir to copy.
+	PatchesHash string   `json:"patches_hash,omitempty"`
+}
+
+func (p PatchSet) Patching() PatchSet { return p }
+
+// LoadPatchSet parses and removes the patch set from the keys of a dependency,
+// before they're converted to strings.
+func LoadPatchSet(rawDep map[string]json.RawMessage) (PatchSet, error) {
+	var p PatchSet
+	if raw, ok := rawDep["patches"]; ok {
+		if err := json.Unmarshal(raw, &p.Patches); err != nil {
+			return PatchSet{}, errors.New("value of key 'patches' must be a list of file names")
+		}
+	}
+	if raw, ok := rawDep["patches_hash"]; ok {
+		if err := json.Unmarshal(raw, &p.PatchesHash); err != nil {
+			return PatchSet{}, errors.New("value of key 'patches_hash' must be a string")
+		}
+	}
+	delete(rawDep, "patches")
+	delete(rawDep, "patches_hash")
+	return p, nil
+}
+
+// SamePatches reports whether a and b list the same patches, in the same
+// order.
+func SamePatches(a, b PatchSet) bool {
+	return sameStrings(a.Patches, b.Patches)
+}
+
+// HashPatches returns the hash of the contents of the patch files, in order,
+// or "" if there are none.
+func HashPatches(files []string) (string, error) {
+	if len(files) == 0 {
+		return "", nil
+	}
+	hash := sha256.New()
+	for _, f := range files {
+		contents, err := ioutil.ReadFile(f)
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(contents)
+		hash.Write(sum[:])
+	}
+	return fmt.Sprintf("sha256:%x", hash.Sum(nil)), nil
+}
+
+// ApplyPatches applies the patch files, in order, to the files in dir.
+func ApplyPatches(dir string, files []string) error {
+	for _, f := range files {
+		LogDebug("Applying patch %q", f)
+		patch, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		if err := ApplyPatch(dir, patch); err != nil {
+			return fmt.Errorf("patch %q does not apply: %v", f, err)
+		}
+	}
+	return nil
+}
+
+// filePatch is the part of a patch changing one file. A name is "" if the
+// file is created or deleted.
+type filePatch struct {
+	oldName string
+	newName string
+	hunks   []hunk
+}
+
+type hunk struct {
+	oldStart int
+	oldCount int
+	ops      []diffOp
+}
+
+// ApplyPatch applies a unified diff, as made by DiffPatch, diff -u or Git,
+// to the files in dir, stripping the first component of the file names. Each
+// hunk must match exactly, though it may have moved.
+func ApplyPatch(dir string, patch []byte) error {
+	files, err := parsePatch(patch)
+	if err != nil {
+		return err
+	}
+	for _, fp := range files {
+		if err := applyFilePatch(dir, fp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parsePatch(patch []byte) ([]filePatch, error) {
+	var files []filePatch
+	lines := splitLines(patch)
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			oldName, err := patchFileName(line[len("--- "):])
+			if err != nil {
+				return nil, err
+			}
+			newName, err := patchFileName(lines[i+1][len("+++ "):])
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, filePatch{oldName: oldName, newName: newName})
+			i++
+
+		case strings.HasPrefix(line, "@@ "):
+			if len(files) == 0 {
+				return nil, fmt.Errorf("line %d: hunk before any file name", i+1)
+			}
+			h, n, err := parseHunk(lines[i:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+			fp := &files[len(files)-1]
+			fp.hunks = append(fp.hunks, h)
+			i += n - 1
+
+		case strings.HasPrefix(line, "Binary files ") || strings.HasPrefix(line, "GIT binary patch"):
+			return nil, fmt.Errorf("line %d: binary patches are not supported", i+1)
+		}
+		// Anything else, like Git's headers, is commentary.
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no files are changed")
+	}
+	return files, nil
+}
+
+// patchFileName returns the name of a file after --- or +++, without its
+// first component, or "" for /dev/null.
+func patchFileName(s string) (string, error) {
+	s = strings.TrimRight(s, "\r\n")
+	if i := strings.IndexByte(s, '\t'); i >= 0 {
+		s = s[:i] // Drop the timestamp.
+	}
+	if s == "/dev/null" {
+		return "", nil
+	}
+	i := strings.IndexByte(s, '/')
+	if i < 0 || s[i+1:] == "" {
+		return "", fmt.Errorf("file name %q has no leading dir to strip", s)
+	}
+	name := s[i+1:]
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "../") || strings.Contains(name, "/../") {
+		return "", fmt.Errorf("file name %q is outside the dependency", s)
+	}
+	return name, nil
+}
+
+// parseHunk parses the hunk at the start of lines, returning it and the
+// number of lines it takes up.
+func parseHunk(lines []string) (hunk, int, error) {
+	var h hunk
+	fields := strings.Fields(lines[0])
+	if len(fields) < 4 || fields[3] != "@@" || !strings.HasPrefix(fields[1], "-") || !strings.HasPrefix(fields[2], "+") {
+		return hunk{}, 0, fmt.Errorf("malformed hunk header %q", strings.TrimSpace(lines[0]))
+	}
+	var newCount int
+	var err error
+	if h.oldStart, h.oldCount, err = parseHunkRange(fields[1][1:]); err != nil {
+		return hunk{}, 0, err
+	}
+	if _, newCount, err = parseHunkRange(fields[2][1:]); err != nil {
+		return hunk{}, 0, err
+	}
+
+	oldLeft, newLeft := h.oldCount, newCount
+	n := 1
+	for ; oldLeft > 0 || newLeft > 0; n++ {
+		if n >= len(lines) {
+			return hunk{}, 0, errors.New("hunk is cut short")
+		}
+		line := lines[n]
+		kind := byte(' ')
+		if line != "\n" && line != "\r\n" { // Some editors strip the space of empty context lines.
+			kind, line = line[0], line[1:]
+		}
+		switch kind {
+		case ' ':
+			oldLeft--
+			newLeft--
+		case '-':
+			oldLeft--
+		case '+':
+			newLeft--
+		case '\\': // No newline at end of file.
+			if len(h.ops) > 0 {
+				h.ops[len(h.ops)-1].line = strings.TrimSuffix(h.ops[len(h.ops)-1].line, "\n")
+			}
+			continue
+		default:
+			return hunk{}, 0, fmt.Errorf("unexpected line %q in hunk", strings.TrimSpace(lines[n]))
+		}
+		if oldLeft < 0 || newLeft < 0 {
+			return hunk{}, 0, errors.New("hunk is longer than its header says")
+		}
+		h.ops = append(h.ops, diffOp{kind, line})
+	}
+	if n < len(lines) && strings.HasPrefix(lines[n], "\\") && len(h.ops) > 0 {
+		h.ops[len(h.ops)-1].line = strings.TrimSuffix(h.ops[len(h.ops)-1].line, "\n")
+		n++
+	}
+	return h, n, nil
+}
+
+// parseHunkRange parses the start and count of the lines of a hunk, formatted
+// as by hunkRange.
+func parseHunkRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, ",", 2)
+	start, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed hunk range %q", s)
+	}
+	count := 1
+	if len(parts) == 2 {
+		if count, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, 0, fmt.Errorf("malformed hunk range %q", s)
+		}
+	}
+	return start, count, nil
+}
+
+func applyFilePatch(dir string, fp filePatch) error {
+	name := fp.newName
+	if name == "" {
+		name = fp.oldName
+	}
+
+	var oldLines []string
+	mode := os.FileMode(0644)
+	if fp.oldName == "" {
+		if _, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(name))); err == nil {
+			return fmt.Errorf("%q, to be created, already exists", name)
+		}
+	} else {
+		p := filepath.Join(dir, filepath.FromSlash(fp.oldName))
+		contents, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		oldLines, mode = splitLines(contents), fi.Mode()
+	}
+
+	var newLines []string
+	pos := 0
+	for i, h := range fp.hunks {
+		var want, got []string
+		for _, op := range h.ops {
+			if op.kind != '+' {
+				want = append(want, op.line)
+			}
+			if op.kind != '-' {
+				got = append(got, op.line)
+			}
+		}
+		expected := h.oldStart - 1
+		if h.oldCount == 0 {
+			expected = h.oldStart
+		}
+		at := findLines(oldLines, want, pos, expected)
+		if at < 0 {
+			return fmt.Errorf("hunk %d of %q does not match at line %d", i+1, name, h.oldStart)
+		}
+		newLines = append(newLines, oldLines[pos:at]...)
+		newLines = append(newLines, got...)
+		pos = at + len(want)
+	}
+	newLines = append(newLines, oldLines[pos:]...)
+
+	if fp.newName == "" {
+		if len(newLines) > 0 {
+			return fmt.Errorf("%q, to be deleted, has lines left", name)
+		}
+		return os.Remove(filepath.Join(dir, filepath.FromSlash(fp.oldName)))
+	}
+	p := filepath.Join(dir, filepath.FromSlash(fp.newName))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(p, []byte(strings.Join(newLines, "")), mode); err != nil {
+		return err
+	}
+	if fp.oldName != "" && fp.oldName != fp.newName {
+		return os.Remove(filepath.Join(dir, filepath.FromSlash(fp.oldName)))
+	}
+	return nil
+}
+
+// findLines returns where want is found in lines, not before from, nearest
+// to expected, or -1 if it isn't.
+func findLines(lines, want []string, from, expected int) int {
+	matches := func(at int) bool {
+		if at < from || at+len(want) > len(lines) {
+			return false
+		}
+		for i, line := range want {
+			if lines[at+i] != line {
+				return false
+			}
+		}
+		return true
+	}
+	for offset := 0; expected-offset >= from || expected+offset+len(want) <= len(lines); offset++ {
+		if matches(expected + offset) {
+			return expected + offset
+		}
+		if matches(expected - offset) {
+			return expected - offset
+		}
+	}
+	return -1
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes files, by slash separated path, into dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, contents := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "courier_test_patch_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	oldDir, newDir := filepath.Join(tmp, "old"), filepath.Join(tmp, "new")
+	var long []string
+	for i := 0; i < 20; i++ {
+		long = append(long, strings.Repeat("x", i)+"\n")
+	}
+	writeFiles(t, oldDir, map[string]string{
+		"same":     "same\n",
+		"edited":   strings.Join(long, ""),
+		"deleted":  "gone\n",
+		"sub/tail": "no newline",
+	})
+	long[1], long[17] = "changed\n", "also changed\n"
+	writeFiles(t, newDir, map[string]string{
+		"same":     "same\n",
+		"edited":   strings.Join(long, ""),
+		"sub/new":  "new\n",
+		"sub/tail": "no newline, still",
+	})
+
+	d, err := DiffDirs(oldDir, newDir, FileFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, err := DiffPatch(oldDir, newDir, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyPatch(oldDir, []byte(patch)); err != nil {
+		t.Fatalf("ApplyPatch: %v\n%s", err, patch)
+	}
+	if d, err := DiffDirs(oldDir, newDir, FileFilter{}); err != nil || !d.Empty() {
+		t.Errorf("ApplyPatch: left differences %+v, %v", d, err)
+	}
+
+	// Hunks may have moved, but must still match.
+	writeFiles(t, newDir, map[string]string{"edited": "inserted\n" + strings.Join(long, "")})
+	if err := ApplyPatch(newDir, []byte("--- a/edited\n+++ b/edited\n@@ -2,3 +2,3 @@\n \n-changed\n+changed again\n xx\n")); err != nil {
+		t.Errorf("ApplyPatch: moved hunk: %v", err)
+	}
+	err = ApplyPatch(newDir, []byte("--- a/edited\n+++ b/edited\n@@ -2,3 +2,3 @@\n \n-not there\n+changed again\n xx\n"))
+	if err == nil || !strings.Contains(err.Error(), `hunk 1 of "edited" does not match at line 2`) {
+		t.Errorf("ApplyPatch: expected error for hunk that doesn't match, got %v", err)
+	}
+	if err := ApplyPatch(newDir, []byte("--- a/../outside\n+++ b/../outside\n@@ -0,0 +1 @@\n+x\n")); err == nil {
+		t.Errorf("ApplyPatch: expected error for file outside dir")
+	}
+}
+
+func TestStageDependencyPatches(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "courier_test_patch_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src, patch := filepath.Join(tmp, "src"), filepath.Join(tmp, "fix.diff")
+	writeFiles(t, src, map[string]string{"file": "one\ntwo\n"})
+	writeFiles(t, tmp, map[string]string{"fix.diff": "--- a/file\n+++ b/file\n@@ -1,2 +1,2 @@\n one\n-two\n+2\n"})
+
+	dep := LocalDependency{VCS: "local", Path: src, CommonKeys: CommonKeys{PatchSet: PatchSet{Patches: []string{patch}}}}
+	staged, err := StageDependency(context.Background(), dep)
+	if err != nil {
+		t.Fatalf("StageDependency: %v", err)
+	}
+	defer os.RemoveAll(staged.StagingDir)
+	if contents, err := ioutil.ReadFile(filepath.Join(staged.StagingDir, "file")); err != nil || string(contents) != "one\n2\n" {
+		t.Errorf("StageDependency: staged %q, %v, expected patched contents", contents, err)
+	}
+	patchesHash, err := HashPatches([]string{patch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := PatchSet{Patches: []string{patch}, PatchesHash: patchesHash}
+	if pinned := staged.Pinned.Patching(); !reflect.DeepEqual(pinned, expected) {
+		t.Errorf("StageDependency: pinned %+v, expected %+v", pinned, expected)
+	}
+	if rev, err := ResolveUpstream(context.Background(), staged.Pinned); err != nil || rev != staged.Pinned.Revision() {
+		t.Errorf("ResolveUpstream: got %q, %v; expected the pinned %q", rev, err, staged.Pinned.Revision())
+	}
+
+	// A patch that no longer applies fails the patch step.
+	writeFiles(t, src, map[string]string{"file": "one\nthree\n"})
+	_, err = StageDependency(context.Background(), dep)
+	if stepErr, ok := err.(*StepError); !ok || stepErr.Step != "patch" {
+		t.Errorf("StageDependency: expected patch step error, got %v", err)
+	}
+
+	// As does one changed since it was pinned.
+	writeFiles(t, src, map[string]string{"file": "one\ntwo\n"})
+	dep.PatchesHash = "sha256:0"
+	_, err = StageDependency(context.Background(), dep)
+	if err == nil || !strings.Contains(err.Error(), "patches hash mismatch") {
+		t.Errorf("StageDependency: expected patches hash mismatch, got %v", err)
+	}
+}
+
+func TestLoadPatchSet(t *testing.T) {
+	m, err := LoadManifest(context.Background(), []byte(`{"lib": {"vcs": "local", "path": "../lib", "patches": ["a.diff", "b.diff"], "patches_hash": "sha256:00"}}`))
+	if err != nil {
+		t.Fatalf("LoadManifest: %v", err)
+	}
+	expected := PatchSet{Patches: []string{"a.diff", "b.diff"}, PatchesHash: "sha256:00"}
+	if got := m["lib"].Patching(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("LoadManifest: got %+v, expected %+v", got, expected)
+	}
+	if _, err := LoadManifest(context.Background(), []byte(`{"lib": {"vcs": "local", "path": "../lib", "patches": "a.diff"}}`)); err == nil {
+		t.Errorf("LoadManifest: expected error for patches that aren't a list")
+	}
+}
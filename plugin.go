@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+)
+
+// pluginPrefix is prepended to the value of "vcs" to get the name of the
+// executable implementing a backend that isn't built in.
+const pluginPrefix = "courier-backend-"
+
+// LookupPlugin returns a backend for vcs implemented by an executable named
+// courier-backend-<vcs> on PATH.
+func LookupPlugin(vcs string) (Backend, bool) {
+	p, err := exec.LookPath(pluginPrefix + vcs)
+	if err != nil {
+		return nil, false
+	}
+	return pluginBackend{vcs: vcs, path: p}, true
+}
+
+// PluginDependency is a dependency obtained by a plugin. Courier knows nothing
+// about its keys other than "vcs", "hash" and the common ones; what it needs
+// to know about the dependency is reported by the plugin.
+type PluginDependency struct {
+	VCS  string
+	Keys map[string]string
+	Info PluginInfo
+	Hash string
+	CommonKeys
+}
+
+// PluginInfo is what a plugin reports about a dependency it has loaded or
+// staged.
+type PluginInfo struct {
+	Source    string `json:"source"` // Identifies where the dependency comes from, e.g. its URL.
+	Revision  string `json:"revision"`
+	Immutable bool   `json:"immutable"`
+	IgnoreDir string `json:"ignore_dir"`
+	DirToCopy string `json:"dir_to_copy"`
+	Host      string `json:"host"`
+}
+
+func (d PluginDependency) Kind() string        { return d.VCS }
+func (d PluginDependency) IgnoreDir() string   { return d.Info.IgnoreDir }
+func (d PluginDependency) DirToCopy() string   { return d.Info.DirToCopy }
+func (d PluginDependency) Revision() string    { return d.Info.Revision }
+func (d PluginDependency) Immutable() bool     { return d.Info.Immutable }
+func (d PluginDependency) ContentHash() string { return d.Hash }
+func (d PluginDependency) Host() string        { return d.Info.Host }
+func (d PluginDependency) Source() string      { return d.Info.Source }
+func (d PluginDependency) SameSource(other Dependency) bool {
+	o, ok := other.(PluginDependency)
+	return ok && o.VCS == d.VCS && o.Info.Source == d.Info.Source
+}
+func (d PluginDependency) WithContentHash(hash string) Dependency {
+	d.Hash = hash
+	return d
+}
+func (d PluginDependency) WithCommon(common CommonKeys) Dependency {
+	d.CommonKeys = common
+	return d
+}
+
+// MarshalJSON writes the dependency back out as the plugin's keys, so that it
+// can be loaded again from a pinned manifest.
+func (d PluginDependency) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{})
+	for k, v := range d.Keys {
+		m[k] = v
+	}
+	m["vcs"] = d.VCS
+	if d.Hash != "" {
+		m["hash"] = d.Hash
+	}
+	if d.Timeout != "" {
+		m["timeout"] = d.Timeout
+	}
+	if d.Retries != nil {
+		m["retries"] = strconv.Itoa(*d.Retries)
+	}
+	if len(d.Patches) > 0 {
+		m["patches"] = d.Patches
+	}
+	if d.PatchesHash != "" {
+		m["patches_hash"] = d.PatchesHash
+	}
+	if len(d.Include) > 0 {
+		m["include"] = d.Include
+	}
+	if len(d.Exclude) > 0 {
+		m["exclude"] = d.Exclude
+	}
+	if d.MappedFrom != "" {
+		m["mapped_from"] = d.MappedFrom
+	}
+	return json.Marshal(m)
+}
+
+// pluginRequest is written to the plugin's stdin.
+type pluginRequest struct {
+	Dependency map[string]string `json:"dependency"`
+	StagingDir string            `json:"staging_dir,omitempty"`
+}
+
+// pluginResponse is read from the plugin's stdout.
+type pluginResponse struct {
+	Dependency map[string]string `json:"dependency"`
+	VCS        string            `json:"vcs"`
+	PluginInfo
+	Immutable *bool `json:"immutable"` // Nil if not reported.
+}
+
+// info returns what the plugin reported about the dependency, keeping what
+// was known before, in info, for what it didn't.
+func (r pluginResponse) info(info PluginInfo) PluginInfo {
+	for _, f := range []struct {
+		dst *string
+		src string
+	}{
+		{&info.Source, r.Source},
+		{&info.Revision, r.Revision},
+		{&info.IgnoreDir, r.IgnoreDir},
+		{&info.DirToCopy, r.DirToCopy},
+		{&info.Host, r.Host},
+	} {
+		if f.src != "" {
+			*f.dst = f.src
+		}
+	}
+	if r.Immutable != nil {
+		info.Immutable = *r.Immutable
+	}
+	return info
+}
+
+type pluginBackend struct {
+	vcs  string
+	path string
+}
+
+func (b pluginBackend) Load(ctx context.Context, depMap map[string]string) (Dependency, error) {
+	d := PluginDependency{VCS: b.vcs, Hash: depMap["hash"]}
+	delete(depMap, "vcs")
+	delete(depMap, "hash")
+	resp, err := b.run(ctx, "load", pluginRequest{Dependency: depMap})
+	if err != nil {
+		return nil, err
+	}
+	d.Keys = resp.Dependency
+	d.Info = resp.info(PluginInfo{})
+	return d, nil
+}
+
+func (b pluginBackend) Stage(ctx context.Context, dep Dependency, stagingDir string) (Dependency, error) {
+	d := dep.(PluginDependency)
+	resp, err := b.run(ctx, "stage", pluginRequest{Dependency: d.Keys, StagingDir: stagingDir})
+	if err != nil {
+		return nil, err
+	}
+	d.Keys = resp.Dependency
+	d.Info = resp.info(d.Info)
+	return d, nil
+}
+
+func (b pluginBackend) Resolve(ctx context.Context, dep Dependency) (string, error) {
+	d := dep.(PluginDependency)
+	resp, err := b.run(ctx, "resolve", pluginRequest{Dependency: d.Keys})
+	if err != nil {
+		return "", err
+	}
+	return resp.Revision, nil
+}
+
+// run runs the plugin with the operation as its argument and the request as
+// JSON on stdin, and reads its response as JSON from stdout. A plugin reports
+// failure by exiting with a non-zero status, and a message on stderr.
+func (b pluginBackend) run(ctx context.Context, op string, req pluginRequest) (pluginResponse, error) {
+	LogDebug(`Running plugin %q %s`, b.path, op)
+	in, err := json.Marshal(req)
+	if err != nil {
+		return pluginResponse{}, err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(b.path, op)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := RunCommand(ctx, cmd); err != nil {
+		return pluginResponse{}, commandError(op, fmt.Errorf("%s %s: %v", pluginPrefix+b.vcs, op, err), stderr.Bytes())
+	}
+	var resp pluginResponse
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return pluginResponse{}, stepError(op, fmt.Errorf("%s %s: invalid response: %v", pluginPrefix+b.vcs, op, err))
+	}
+	if resp.VCS != "" && resp.VCS != b.vcs {
+		return pluginResponse{}, stepError(op, fmt.Errorf("%s %s: reported vcs %q", pluginPrefix+b.vcs, op, resp.VCS))
+	}
+	if resp.Dependency == nil {
+		resp.Dependency = req.Dependency
+	}
+	return resp, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPlugin = `#!/bin/sh
+req=$(cat)
+if echo "$req" | grep -q '"fail"'; then
+	echo "something went wrong" >&2
+	exit 1
+fi
+if echo "$req" | grep -q '"hang"'; then
+	sleep 3
+fi
+if echo "$req" | grep -q '"other"'; then
+	echo '{"vcs": "otherstore"}'
+	exit 0
+fi
+case "$1" in
+load|resolve)
+	echo '{"source": "store/lib", "revision": "1.0", "immutable": true}'
+	;;
+stage)
+	dir=$(echo "$req" | sed -n 's/.*"staging_dir":"\([^"]*\)".*/\1/p')
+	echo hello > "$dir/file"
+	echo '{"dependency": {"name": "lib", "version": "1.0"}, "vcs": "teststore", "revision": "1.0"}'
+	;;
+*)
+	echo "unknown operation $1" >&2
+	exit 1
+	;;
+esac
+`
+
+func TestPluginBackend(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found on PATH")
+	}
+	bin, err := ioutil.TempDir("", "courier_test_plugin_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bin)
+	if err := ioutil.WriteFile(filepath.Join(bin, "courier-backend-teststore"), []byte(testPlugin), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	m, err := LoadManifest(context.Background(), []byte(`{"dep": {"vcs": "teststore", "name": "lib"}}`))
+	if err != nil {
+		t.Fatalf("LoadManifest: %v", err)
+	}
+	if !m["dep"].Immutable() || m["dep"].Revision() != "1.0" {
+		t.Errorf("LoadManifest: got %v, expected immutable revision %q", m["dep"], "1.0")
+	}
+
+	stagedDeps, err := StageDependencies(context.Background(), m)
+	if err != nil {
+		t.Fatalf("StageDependencies: %v", err)
+	}
+	staged := stagedDeps["dep"]
+	defer os.RemoveAll(staged.StagingDir)
+	if buf, err := ioutil.ReadFile(filepath.Join(staged.StagingDir, "file")); err != nil || string(buf) != "hello\n" {
+		t.Errorf("StageDependencies: file = %q, %v; expected %q", buf, err, "hello\n")
+	}
+
+	// What the plugin didn't report when staging is kept from loading.
+	if info := staged.Pinned.(PluginDependency).Info; info.Source != "store/lib" || !info.Immutable {
+		t.Errorf("StageDependencies: got %+v, expected source %q and immutable", info, "store/lib")
+	}
+
+	// The pin can be written out and loaded again.
+	raw, err := json.Marshal(Manifest{"dep": staged.Pinned})
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	pinned, err := LoadPinnedManifest(context.Background(), raw)
+	if err != nil {
+		t.Fatalf("LoadPinnedManifest: %s: %v", raw, err)
+	}
+	pin := pinned["dep"].(PluginDependency)
+	if pin.Keys["version"] != "1.0" || pin.Hash == "" || pin.Hash != staged.Pinned.ContentHash() {
+		t.Errorf("LoadManifest: %s: got %v", raw, pin)
+	}
+	if !PinMatches(m["dep"], pin) {
+		t.Errorf("PinMatches: expected %v to match %v", m["dep"], pin)
+	}
+	if rev, err := ResolveUpstream(context.Background(), pin); err != nil || rev != "1.0" {
+		t.Errorf("ResolveUpstream: got %q, %v; expected %q", rev, err, "1.0")
+	}
+
+	_, err = LoadManifest(context.Background(), []byte(`{"dep": {"vcs": "teststore", "name": "fail"}}`))
+	if err == nil || !strings.Contains(err.Error(), "something went wrong") {
+		t.Errorf("LoadManifest: got error %v, expected the plugin's message", err)
+	}
+
+	_, err = LoadManifest(context.Background(), []byte(`{"dep": {"vcs": "teststore", "name": "other"}}`))
+	if err == nil || !strings.Contains(err.Error(), "otherstore") {
+		t.Errorf("LoadManifest: got error %v, expected the reported vcs to be rejected", err)
+	}
+
+	// A plugin that hangs while loading is killed once the timeout is up.
+	start := time.Now()
+	if _, err := LoadManifest(context.Background(), []byte(`{"dep": {"vcs": "teststore", "name": "hang", "timeout": "200ms"}}`)); err == nil {
+		t.Errorf("LoadManifest: expected error for plugin that timed out")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("LoadManifest: returned after %v, expected soon after the timeout", elapsed)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FetchOptions control how a dependency is obtained. Unset options take their
+// value from the command line.
+type FetchOptions struct {
+	Timeout string `json:"timeout,omitempty"` // e.g. "10m".
+	Retries *int   `json:"retries,omitempty"`
+}
+
+func (o FetchOptions) Options() FetchOptions { return o }
+
+// Policy returns the timeout of each attempt, or 0 for none, and the number
+// of times to retry.
+func (o FetchOptions) Policy() (time.Duration, int) {
+	timeout, retries := cmdLineArgs.timeout, cmdLineArgs.retries
+	if o.Timeout != "" {
+		timeout, _ = time.ParseDuration(o.Timeout) // Checked by LoadFetchOptions.
+	}
+	if o.Retries != nil {
+		retries = *o.Retries
+	}
+	return timeout, retries
+}
+
+// LoadFetchOptions parses and removes the fetch options from the keys of a
+// dependency.
+func LoadFetchOptions(depMap map[string]string) (FetchOptions, error) {
+	var o FetchOptions
+	if timeout, ok := depMap["timeout"]; ok {
+		if d, err := time.ParseDuration(timeout); err != nil || d <= 0 {
+			return FetchOptions{}, fmt.Errorf("invalid value %q for key 'timeout'", timeout)
+		}
+		o.Timeout = timeout
+	}
+	if retries, ok := depMap["retries"]; ok {
+		n, err := strconv.Atoi(retries)
+		if err != nil || n < 0 {
+			return FetchOptions{}, fmt.Errorf("invalid value %q for key 'retries'", retries)
+		}
+		o.Retries = &n
+	}
+	delete(depMap, "timeout")
+	delete(depMap, "retries")
+	return o, nil
+}
+
+// transientErrors are parts of the messages of errors, mostly from Git, SVN,
+// Mercurial and HTTP servers, that may not happen if tried again.
+var transientErrors = []string{
+	"could not resolve host",
+	"temporary failure in name resolution",
+	"connection timed out",
+	"connection reset",
+	"connection refused",
+	"connection closed",
+	"operation timed out",
+	"early eof",
+	"the remote end hung up unexpectedly",
+	"rpc failed",
+	"temporarily unavailable",
+	"tls handshake timeout",
+	"429 too many requests",
+	"502 bad gateway",
+	"503 service unavailable",
+	"504 gateway timeout",
+}
+
+// IsTransientError reports whether err may not happen if what failed is tried
+// again.
+func IsTransientError(err error) bool {
+	cause := err
+	if stepErr, ok := err.(*StepError); ok {
+		cause = stepErr.Err
+	}
+	if netErr, ok := cause.(net.Error); ok && (netErr.Timeout() || netErr.Temporary()) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range transientErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// timeoutError returns err, from an attempt killed after timeout, saying so.
+func timeoutError(err error, timeout time.Duration) error {
+	msg := fmt.Errorf("timed out after %s", timeout)
+	if stepErr, ok := err.(*StepError); ok {
+		e := *stepErr
+		e.Err = msg
+		return &e
+	}
+	return fmt.Errorf("%v: %v", msg, err)
+}
+
+// Retry calls op until it succeeds, fails with an error that isn't transient,
+// or has been retried as many times as opts allow, waiting twice as long as
+// before, starting from --retry-delay, between attempts. Each attempt is
+// given the timeout from opts.
+func Retry(ctx context.Context, what string, opts FetchOptions, op func(ctx context.Context) error) error {
+	timeout, retries := opts.Policy()
+	delay := cmdLineArgs.retryDelay
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			LogInfo(`Retrying %s (attempt %d of %d)`, what, attempt+1, retries+1)
+		}
+
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		err := op(attemptCtx)
+		timedOut := attemptCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+		cancel()
+
+		switch {
+		case err == nil:
+			return nil
+		case timedOut:
+			err = timeoutError(err, timeout)
+		case ctx.Err() != nil || !IsTransientError(err):
+			return err
+		}
+		if attempt >= retries {
+			return err
+		}
+
+		LogWarn(`Failed %s, retrying in %s: %v`, what, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
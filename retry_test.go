@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLoadFetchOptions(t *testing.T) {
+	m, err := LoadManifest(context.Background(), []byte(`{"dep": {"vcs": "git", "url": "u", "ref": "r", "dir": "", "timeout": "5m", "retries": 3}}`))
+	if err != nil {
+		t.Fatalf("LoadManifest: %v", err)
+	}
+	if timeout, retries := m["dep"].Options().Policy(); timeout != 5*time.Minute || retries != 3 {
+		t.Errorf("Policy: got %s, %d; expected %s, %d", timeout, retries, 5*time.Minute, 3)
+	}
+	for _, js := range []string{
+		`{"dep": {"vcs": "git", "url": "u", "ref": "r", "dir": "", "timeout": "5"}}`,
+		`{"dep": {"vcs": "git", "url": "u", "ref": "r", "dir": "", "retries": -1}}`,
+	} {
+		if _, err := LoadManifest(context.Background(), []byte(js)); err == nil {
+			t.Errorf("LoadManifest: %s: expected error", js)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	defer func(delay time.Duration, retries int) {
+		cmdLineArgs.retryDelay, cmdLineArgs.retries = delay, retries
+	}(cmdLineArgs.retryDelay, cmdLineArgs.retries)
+	cmdLineArgs.retryDelay, cmdLineArgs.retries = time.Millisecond, 2
+
+	tests := []struct {
+		err      error
+		attempts int
+	}{
+		{nil, 1},
+		{errors.New("fatal: repository 'x' not found"), 1},
+		{errors.New("fatal: unable to access 'x': Could not resolve host: x"), 3},
+	}
+	for _, test := range tests {
+		attempts := 0
+		err := Retry(context.Background(), "testing", FetchOptions{}, func(ctx context.Context) error {
+			attempts++
+			return test.err
+		})
+		if err != test.err || attempts != test.attempts {
+			t.Errorf("Retry: %v: got %v after %d attempts, expected %d attempts", test.err, err, attempts, test.attempts)
+		}
+	}
+
+	// Attempts that time out are retried.
+	retries := 1
+	attempts := 0
+	err := Retry(context.Background(), "testing", FetchOptions{Timeout: "10ms", Retries: &retries}, func(ctx context.Context) error {
+		attempts++
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err == nil || attempts != 2 {
+		t.Errorf("Retry: got %v after %d attempts, expected a timeout after 2", err, attempts)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// savePatch saves the local edits of the copy of a dependency, relative to
+// its pin, as a patch file, and adds it to the dependency's patches in the
+// primary manifest.
+func savePatch(ctx context.Context, args []string) error {
+
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("save-patch requires the dependency's dir, and optionally the patch file to write")
+	}
+
+	raw, err := ioutil.ReadFile(cmdLineArgs.primaryManifest)
+	if err != nil {
+		return err
+	}
+	var primary map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &primary); err != nil {
+		return enrichJSONError(err, string(raw))
+	}
+	dir, err := findDependencyDir(primary, args[0])
+	if err != nil {
+		return err
+	}
+	patches, err := LoadPatchSet(primary[dir])
+	if err != nil {
+		return fmt.Errorf("%v in dependency '%s'", err, dir)
+	}
+
+	pinned, err := readPinnedManifest(ctx)
+	if err != nil {
+		return err
+	}
+	pin, ok := pinned[dir]
+	if !ok {
+		return fmt.Errorf("dependency %q is not pinned, update it to pin it", dir)
+	}
+	if !SamePatches(patches, pin.Patching()) {
+		return fmt.Errorf("dependency %q has different patches to its pin, update it to pin them", dir)
+	}
+
+	// Compare the pinned contents, with any patches already applied, with the
+	// copy.
+	diffs, err := DiffDependencies(ctx, Manifest{dir: pin}, true)
+	if err != nil {
+		return err
+	}
+	if len(diffs) == 0 {
+		LogInfo("Dependency %q has no local edits", dir)
+		return nil
+	}
+	d := diffs[0]
+	if d.Missing {
+		return fmt.Errorf("dependency %q is missing", dir)
+	}
+	for _, line := range splitLines([]byte(d.Patch)) {
+		if strings.HasPrefix(line, "Binary files ") || strings.HasPrefix(line, "Files ") {
+			return fmt.Errorf("dependency %q has edits that can't be saved as a patch: %s", dir, strings.TrimSpace(line))
+		}
+	}
+	for _, p := range d.ModeChanged {
+		LogWarn("Not saving the change of mode of %q, which patches can't make", path.Join(dir, p))
+	}
+	if d.Patch == "" {
+		return fmt.Errorf("dependency %q has no edits that can be saved as a patch", dir)
+	}
+
+	// Write the patch, without overwriting any other.
+	patchFile := filepath.Join("patches", fmt.Sprintf("%s-%d.diff", strings.Replace(dir, "/", "-", -1), len(patches.Patches)+1))
+	if len(args) == 2 {
+		patchFile = args[1]
+	}
+	if _, err := os.Lstat(patchFile); err == nil {
+		return fmt.Errorf("patch file %q already exists", patchFile)
+	}
+	if err := os.MkdirAll(filepath.Dir(patchFile), 0755); err != nil {
+		return err
+	}
+	LogInfo("Saving local edits of dependency %q to %q", dir, patchFile)
+	if err := ioutil.WriteFile(patchFile, []byte(d.Patch), 0644); err != nil {
+		return err
+	}
+
+	// Add it to the dependency's patches, leaving the rest of the manifest as
+	// it was written.
+	if patches.PatchesHash != "" {
+		LogWarn("Dropping 'patches_hash' of dependency %q, which is only for pinned manifests", dir)
+		if raw, err = removeEntryKey(raw, dir, "patches_hash"); err != nil {
+			return err
+		}
+	}
+	var value bytes.Buffer
+	enc := json.NewEncoder(&value)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(append(patches.Patches, filepath.ToSlash(patchFile))); err != nil {
+		return err
+	}
+	if raw, err = setEntryKey(raw, dir, "patches", bytes.TrimSpace(value.Bytes())); err != nil {
+		return err
+	}
+	LogInfo("Adding the patch to dependency %q in %q", dir, cmdLineArgs.primaryManifest)
+	if err := ioutil.WriteFile(cmdLineArgs.primaryManifest, raw, 0644); err != nil {
+		return err
+	}
+
+	LogInfo("Run \"courier update %s\" to re-pin it with the patch", dir)
+	return nil
+}
+
+// findDependencyDir returns the key of m naming the same dir as dir.
+func findDependencyDir(m map[string]map[string]json.RawMessage, dir string) (string, error) {
+	for key := range m {
+		if path.Clean(key) == path.Clean(dir) {
+			return key, nil
+		}
+	}
+	return "", fmt.Errorf("no dependency %q in %q", dir, cmdLineArgs.primaryManifest)
+}
+
+// jsonMember is a member of a JSON object, by the offsets of its key and the
+// end of its value in the JSON.
+type jsonMember struct {
+	name       string
+	start      int
+	valueStart int
+	end        int
+}
+
+// setEntryKey sets key of the entry dir of the manifest raw to value, replacing
+// its value if it's there and adding it after the entry's last key if not.
+func setEntryKey(raw []byte, dir, key string, value []byte) ([]byte, error) {
+	members, end, err := entryMembers(raw, dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range members {
+		if m.name == key {
+			return splice(raw, m.valueStart, m.end, value), nil
+		}
+	}
+	name, _ := json.Marshal(key) // Can't fail for a string.
+	member := append(append(name, ": "...), value...)
+	if len(members) == 0 {
+		return splice(raw, end, end, member), nil
+	}
+	// Lay it out like the last key.
+	last := members[len(members)-1]
+	indent := last.start
+	for indent > 0 && isJSONSpace(raw[indent-1]) {
+		indent--
+	}
+	space := raw[indent:last.start]
+	if len(space) == 0 {
+		space = []byte(" ")
+	}
+	member = append(append([]byte{','}, space...), member...)
+	return splice(raw, last.end, last.end, member), nil
+}
+
+// removeEntryKey removes key, if it's there, from the entry dir of the
+// manifest raw.
+func removeEntryKey(raw []byte, dir, key string) ([]byte, error) {
+	members, _, err := entryMembers(raw, dir)
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range members {
+		if m.name != key {
+			continue
+		}
+		switch {
+		case i > 0:
+			return splice(raw, members[i-1].end, m.end, nil), nil
+		case len(members) > 1:
+			return splice(raw, m.start, members[1].start, nil), nil
+		default:
+			return splice(raw, m.start, m.end, nil), nil
+		}
+	}
+	return raw, nil
+}
+
+// splice returns raw with the bytes from start to end replaced by b.
+func splice(raw []byte, start, end int, b []byte) []byte {
+	spliced := append(append([]byte(nil), raw[:start]...), b...)
+	return append(spliced, raw[end:]...)
+}
+
+// entryMembers returns the members of the entry dir of the manifest raw, and
+// the offset of the brace closing it.
+func entryMembers(raw []byte, dir string) ([]jsonMember, int, error) {
+	entries, _, err := objectMembers(raw, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, e := range entries {
+		if e.name == dir {
+			return objectMembers(raw, e.valueStart)
+		}
+	}
+	return nil, 0, fmt.Errorf("no dependency %q in %q", dir, cmdLineArgs.primaryManifest)
+}
+
+// objectMembers returns the members of the JSON object at offset i of raw, and
+// the offset of the brace closing it.
+func objectMembers(raw []byte, i int) ([]jsonMember, int, error) {
+	malformed := errors.New("malformed JSON object")
+	if i = skipJSONSpace(raw, i); i >= len(raw) || raw[i] != '{' {
+		return nil, 0, malformed
+	}
+	var members []jsonMember
+	for i = skipJSONSpace(raw, i+1); i < len(raw) && raw[i] != '}'; {
+		var m jsonMember
+		m.start = i
+		end, err := skipJSONValue(raw, i)
+		if err != nil || raw[i] != '"' {
+			return nil, 0, malformed
+		}
+		if err := json.Unmarshal(raw[i:end], &m.name); err != nil {
+			return nil, 0, malformed
+		}
+		if i = skipJSONSpace(raw, end); i >= len(raw) || raw[i] != ':' {
+			return nil, 0, malformed
+		}
+		m.valueStart = skipJSONSpace(raw, i+1)
+		if m.end, err = skipJSONValue(raw, m.valueStart); err != nil {
+			return nil, 0, malformed
+		}
+		members = append(members, m)
+		if i = skipJSONSpace(raw, m.end); i < len(raw) && raw[i] == ',' {
+			i = skipJSONSpace(raw, i+1)
+		}
+	}
+	if i >= len(raw) {
+		return nil, 0, malformed
+	}
+	return members, i, nil
+}
+
+// skipJSONValue returns the offset just after the JSON value at offset i of
+// raw.
+func skipJSONValue(raw []byte, i int) (int, error) {
+	depth := 0
+	for ; i < len(raw); i++ {
+		switch raw[i] {
+		case '"':
+			for i++; i < len(raw) && raw[i] != '"'; i++ {
+				if raw[i] == '\\' {
+					i++
+				}
+			}
+			if depth == 0 && i < len(raw) {
+				return i + 1, nil
+			}
+		case '{', '[':
+			depth++
+		case '}', ']':
+			if depth == 0 { // The end of a number, true, false or null.
+				return i, nil
+			}
+			if depth--; depth == 0 {
+				return i + 1, nil
+			}
+		case ',', ' ', '\t', '\n', '\r':
+			if depth == 0 {
+				return i, nil
+			}
+		}
+	}
+	if depth != 0 || i > len(raw) {
+		return 0, errors.New("unexpected end of JSON")
+	}
+	return i, nil
+}
+
+func skipJSONSpace(raw []byte, i int) int {
+	for i < len(raw) && isJSONSpace(raw[i]) {
+		i++
+	}
+	return i
+}
+
+func isJSONSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
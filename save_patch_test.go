@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSavePatch(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "courier_test_save_patch_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src, dst, patchFile := filepath.Join(tmp, "src"), filepath.Join(tmp, "dst"), filepath.Join(tmp, "edits.diff")
+	writeFiles(t, src, map[string]string{"file": "one\ntwo\n", "other": "other\n"})
+
+	oldArgs := cmdLineArgs
+	defer func() { cmdLineArgs = oldArgs }()
+	cmdLineArgs.primaryManifest = filepath.Join(tmp, "deps.json")
+	cmdLineArgs.pinnedManifest = filepath.Join(tmp, "pins.json")
+
+	dep := LocalDependency{VCS: "local", Path: src}
+	staged, err := StageDependency(context.Background(), dep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(staged.StagingDir)
+	if err := savePinnedManifest(Manifest{dst: staged.Pinned}); err != nil {
+		t.Fatal(err)
+	}
+	other := `"other": {"url": "https://example.com/get?a=1&b=2", "vcs": "archive", "format": "zip", "sha256": "` + strings.Repeat("0", 64) + `"}`
+	manifest := "{\n\t" + other + ",\n\t\"" + filepath.ToSlash(dst) + "\": {\n\t\t\"vcs\": \"local\",\n\t\t\"path\": \"" + filepath.ToSlash(src) + "\",\n\t\t\"timeout\": \"1m\""
+	writeFiles(t, tmp, map[string]string{"deps.json": manifest + "\n\t}\n}\n"})
+
+	// Edit the copy.
+	writeFiles(t, dst, map[string]string{"file": "one\n2\n", "other": "other\n", "added": "new\n"})
+	if err := savePatch(context.Background(), []string{dst, patchFile}); err != nil {
+		t.Fatalf("savePatch: %v", err)
+	}
+
+	// The dependency now has the patch, which reproduces the edits, and the
+	// rest of the manifest is as it was.
+	raw, err := ioutil.ReadFile(cmdLineArgs.primaryManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := manifest + ",\n\t\t\"patches\": [\"" + filepath.ToSlash(patchFile) + "\"]\n\t}\n}\n"; string(raw) != expected {
+		t.Errorf("savePatch: manifest is\n%s\nexpected\n%s", raw, expected)
+	}
+	m, err := readManifest(context.Background(), cmdLineArgs.primaryManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched := m[dst]
+	if patches := patched.Patching().Patches; !reflect.DeepEqual(patches, []string{filepath.ToSlash(patchFile)}) {
+		t.Errorf("savePatch: dependency has patches %q", patches)
+	}
+	if timeout := patched.Options().Timeout; timeout != "1m" {
+		t.Errorf("savePatch: dependency lost its other keys")
+	}
+	staged, err = StageDependency(context.Background(), patched)
+	if err != nil {
+		t.Fatalf("StageDependency: %v", err)
+	}
+	defer os.RemoveAll(staged.StagingDir)
+	if d, err := DiffDirs(staged.StagingDir, dst, FileFilter{}); err != nil || !d.Empty() {
+		t.Errorf("savePatch: patched dependency differs from its copy: %+v, %v", d, err)
+	}
+
+	// Patches are only saved on top of those pinned.
+	if err := savePatch(context.Background(), []string{dst, filepath.Join(tmp, "more.diff")}); err == nil {
+		t.Errorf("savePatch: expected error for patches that differ from the pin's")
+	}
+
+	// An existing patch file isn't overwritten.
+	if err := savePinnedManifest(Manifest{dst: staged.Pinned}); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, dst, map[string]string{"file": "one\n3\n"})
+	if err := savePatch(context.Background(), []string{dst, patchFile}); err == nil {
+		t.Errorf("savePatch: expected error for existing patch file")
+	}
+}
+
+func TestSetEntryKey(t *testing.T) {
+	for _, test := range []struct {
+		raw, expected string
+	}{
+		{`{"a": {}, "b": {"x": 1}}`, `{"a": {"patches": ["p"]}, "b": {"x": 1}}`},
+		{`{"a": {"x": [1, {"y": "}"}]}}`, `{"a": {"x": [1, {"y": "}"}], "patches": ["p"]}}`},
+		{`{"a": {"patches": ["o"], "x": true}}`, `{"a": {"patches": ["p"], "x": true}}`},
+		{`{"a": {"patches_hash": "h", "x": "\"", "patches": []}}`, `{"a": {"x": "\"", "patches": ["p"]}}`},
+		{`{"a": {"x": null, "patches_hash": "h"}}`, `{"a": {"x": null, "patches": ["p"]}}`},
+	} {
+		raw, err := removeEntryKey([]byte(test.raw), "a", "patches_hash")
+		if err == nil {
+			raw, err = setEntryKey(raw, "a", "patches", []byte(`["p"]`))
+		}
+		if err != nil || string(raw) != test.expected {
+			t.Errorf("setEntryKey: %s: got %s, %v, expected %s", test.raw, raw, err, test.expected)
+		}
+	}
+}
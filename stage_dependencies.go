@@ -1,74 +1,161 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"os"
 	"path"
-	"reflect"
+	"sort"
 	"sync"
+	"time"
 )
 
 type StagedDependency struct {
 	StagingDir string
 	Pinned     Dependency
+	Unchanged  bool // The dependency is already in place, so wasn't staged.
 }
 
-func StageDependencies(sources Manifest) (map[string]StagedDependency, error) {
+// StageDependencies stages each dependency, or none if any fails.
+func StageDependencies(ctx context.Context, sources Manifest) (map[string]StagedDependency, error) {
+	stagedDeps, failed := StageEachDependency(ctx, sources)
+	if len(failed) > 0 {
+		removeStaged(stagedDeps)
+		return nil, &StagingError{Failed: failed}
+	}
+	return stagedDeps, nil
+}
+
+// removeStaged removes the staging dirs of stagedDeps, of those that were
+// staged.
+func removeStaged(stagedDeps map[string]StagedDependency) {
+	for _, stagedDep := range stagedDeps {
+		if stagedDep.StagingDir == "" {
+			continue
+		}
+		LogDebug("Removing dir %q", stagedDep.StagingDir)
+		if err := os.RemoveAll(stagedDep.StagingDir); err != nil {
+			LogWarn("Could not clean up dir %q", stagedDep.StagingDir)
+		}
+	}
+}
+
+// StageEachDependency stages each dependency, returning those staged and,
+// sorted by dir, why the others failed.
+func StageEachDependency(ctx context.Context, sources Manifest) (map[string]StagedDependency, []DependencyError) {
 
 	var mu sync.Mutex
-	var fail bool
+	var failed []DependencyError
 	stagedDeps := make(map[string]StagedDependency)
 
+	// Dependencies mapped from the same entry are staged together.
+	groups := groupMapped(sources)
+
 	var wg sync.WaitGroup
-	wg.Add(len(sources))
+	wg.Add(len(groups))
 
-	for dir, dep := range sources {
-		go func(dir string, dep Dependency) {
+	for name, group := range groups {
+		go func(name string, group Manifest) {
 
 			defer wg.Done()
 
-			var err error
-			var staged StagedDependency
-			LogInfo(`Staging dependency %q`, dir)
-			switch dep := dep.(type) {
-			case GitDependency:
-				staged, err = StageGitDependency(dep)
-			case SVNDependency:
-				staged, err = StageSVNDependency(dep)
-			default:
-				staged, err = StagedDependency{}, fmt.Errorf("Unknown dependency type '%v'", reflect.TypeOf(dep))
+			var first Dependency
+			for _, dep := range group {
+				first = dep
 			}
+			release := jobs.acquire(DependencyHost(first))
+			var staged map[string]StagedDependency
+			err := ctx.Err() // Don't start staging once cancelled.
+			start := time.Now()
+			if err == nil {
+				for dir, dep := range group {
+					LogInfo(`Staging dependency %q`, dir)
+					EmitEvent(Event{Event: "stage_started", Dir: dir, VCS: dep.Kind()})
+				}
+				err = Retry(ctx, fmt.Sprintf("staging dependency %q", name), first.Options(), func(ctx context.Context) error {
+					var err error
+					staged, err = stageGroup(ctx, group)
+					return err
+				})
+			}
+			release()
 
 			mu.Lock()
 			defer mu.Unlock()
 
-			if err != nil {
-				LogWarn(`Error while staging dependency %q: %v`, dir, err)
-				fail = true
+			for dir, dep := range group {
+				if err != nil {
+					if ctx.Err() != nil {
+						LogDebug(`Cancelled staging dependency %q: %v`, dir, err)
+					} else {
+						LogWarn(`Error while staging dependency %q: %v`, dir, err)
+					}
+					depErr := NewDependencyError(dir, dep, err)
+					EmitEvent(Event{Event: "error", Dir: dir, VCS: dep.Kind(), DurationMS: msSince(start), Step: depErr.Step, Error: err.Error()})
+					failed = append(failed, depErr)
+				} else {
+					LogInfo(`Finished staging dependency %q`, dir)
+					EmitEvent(Event{Event: "stage_finished", Dir: dir, VCS: dep.Kind(), Revision: staged[dir].Pinned.Revision(), DurationMS: msSince(start)})
+					stagedDeps[dir] = staged[dir]
+				}
 			}
 
-			LogInfo(`Finished staging dependency %q`, dir)
-			stagedDeps[dir] = staged
-
-		}(dir, dep)
+		}(name, group)
 	}
 
 	wg.Wait()
 
-	if fail {
-		for _, stagedDep := range stagedDeps {
-			LogDebug("Removing dir %q", stagedDep.StagingDir)
-			if err := os.RemoveAll(stagedDep.StagingDir); err != nil {
-				LogWarn("Could not clean up dir %q", stagedDep.StagingDir)
-			}
+	sort.Sort(byDir(failed))
+	return stagedDeps, failed
+}
+
+// ReusePins splits m into the dependencies that need staging and those that
+// don't. A dependency doesn't need staging if it refers to an immutable
+// revision, its pin in pinned is of that same revision, with the same patches,
+// and has a content hash, and what is on disk already matches that hash.
+func ReusePins(m, pinned Manifest) (Manifest, map[string]StagedDependency, error) {
+	var toStage Manifest = make(map[string]Dependency)
+	reused := make(map[string]StagedDependency)
+	for dir, dep := range m {
+		pin, ok := pinned[dir]
+		if !ok || !dep.Immutable() || !PinMatches(dep, pin) || !PinnedAt(dep, pin) ||
+			pin.ContentHash() == "" || (dep.ContentHash() != "" && dep.ContentHash() != pin.ContentHash()) {
+			toStage[dir] = dep
+			continue
 		}
-		return nil, errors.New("failed to stage all dependencies")
+		patchesHash, err := HashPatches(dep.Patching().Patches)
+		if err != nil {
+			return nil, nil, err
+		}
+		if patchesHash != pin.Patching().PatchesHash {
+			toStage[dir] = dep
+			continue
+		}
+		dstHash, err := CreateDirHash(dir, DependencyFiles(pin))
+		if os.IsNotExist(err) || (err == nil && FormatDirHash(dstHash) != pin.ContentHash()) {
+			toStage[dir] = dep
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		LogDebug(`Reusing pin of dependency %q`, dir)
+		EmitEvent(Event{Event: "skipped", Dir: dir, VCS: pin.Kind(), Revision: pin.Revision(), Reason: "pinned and unchanged"})
+		reused[dir] = StagedDependency{Pinned: pin, Unchanged: true}
 	}
-	return stagedDeps, nil
+	return toStage, reused, nil
 }
 
-func StageGitDependency(dep GitDependency) (staged StagedDependency, err error) {
+// StageDependency obtains dep into a new staging dir using its backend, and
+// pins it. If dep already has a content hash, then the staged contents must
+// match it.
+func StageDependency(ctx context.Context, dep Dependency) (staged StagedDependency, err error) {
+
+	var backend Backend
+	backend, err = LookupBackend(dep.Kind())
+	if err != nil {
+		err = stepError("load", err)
+		return
+	}
 
 	// Get a temp dir.
 	staged.StagingDir, err = MakeTmpDir()
@@ -84,75 +171,82 @@ func StageGitDependency(dep GitDependency) (staged StagedDependency, err error)
 		}
 	}()
 
-	// Clone into it.
-	err = GitClone(staged.StagingDir, dep.URL)
+	// Obtain the dependency.
+	var pin Dependency
+	pin, err = backend.Stage(ctx, dep, staged.StagingDir)
 	if err != nil {
+		err = stepError("stage", err)
 		return
 	}
 
-	// Check out the right commit.
-	err = GitCheckout(staged.StagingDir, dep.Ref)
-	if err != nil {
-		return
-	}
+	staged, err = finishStaging(dep, pin, staged.StagingDir)
+	return
+}
+
+// finishStaging pins dep, obtained into stagingDir as pin by its backend. If
+// dep already has a content hash, then the staged contents must match it.
+func finishStaging(dep, pin Dependency, stagingDir string) (staged StagedDependency, err error) {
 
-	// Make sure the subdirectory we want actually exits in the repo.
+	staged.StagingDir = stagingDir
+
+	// Make sure the subdirectory we want actually exits in what was obtained.
+	src := path.Join(stagingDir, pin.DirToCopy())
 	var fi os.FileInfo
-	fi, err = os.Stat(path.Join(staged.StagingDir, dep.Dir))
+	fi, err = os.Stat(src)
 	if err != nil {
+		err = stepError("stat", err)
 		return
 	}
 	if !fi.IsDir() {
-		err = fmt.Errorf("%q is not a dir", path.Join(staged.StagingDir, dep.Dir))
-		return
-	}
-
-	// Get the SHA1 so we can reproduce the exact version of the external.
-	var pin GitDependency = dep
-	pin.Ref, err = GitGetSHA1(staged.StagingDir)
-	if err != nil {
-		return
-	}
-	staged.Pinned = pin
-
-	return
-}
-
-func StageSVNDependency(dep SVNDependency) (staged StagedDependency, err error) {
-
-	// Get a temp dir.
-	staged.StagingDir, err = MakeTmpDir()
-	if err != nil {
+		err = stepError("stat", fmt.Errorf("%q is not a dir", src))
 		return
 	}
 
-	// Clean up on exit if something went wrong.
-	defer func() {
+	// Apply the dependency's own changes, checking they're what was pinned.
+	patches := dep.Patching()
+	if len(patches.Patches) > 0 {
+		var patchesHash string
+		patchesHash, err = HashPatches(patches.Patches)
 		if err != nil {
-			_ = os.RemoveAll(staged.StagingDir) // If this errors out, there's not much we can do.
-			staged = StagedDependency{}         // Clear staged to hide what happen from the user.
+			err = stepError("patch", err)
+			return
 		}
-	}()
-
-	// Checkout the repo.
-	if dep.Rev == nil {
-		err = SVNCheckoutLatest(staged.StagingDir, dep.URL)
-	} else {
-		err = SVNCheckoutAtRev(staged.StagingDir, dep.URL, *dep.Rev)
+		if patches.PatchesHash != "" && patches.PatchesHash != patchesHash {
+			err = stepError("patch", fmt.Errorf("patches hash mismatch: pinned %s, patches %s", patches.PatchesHash, patchesHash))
+			return
+		}
+		if err = ApplyPatches(src, patches.Patches); err != nil {
+			err = stepError("patch", err)
+			return
+		}
+		common := pin.Common()
+		common.PatchSet = PatchSet{Patches: patches.Patches, PatchesHash: patchesHash}
+		pin = pin.WithCommon(common)
 	}
+
+	// Record the hash of the contents, checking they're what was pinned.
+	var hash []byte
+	hash, err = CreateDirHash(src, DependencyFiles(pin))
 	if err != nil {
+		err = stepError("hash", err)
 		return
 	}
-
-	// Get checked out revision.
-	var pin SVNDependency = dep
-	var rev string
-	rev, err = SVNVersion(staged.StagingDir)
-	pin.Rev = &rev
-	if err != nil {
+	if dep.ContentHash() != "" && dep.ContentHash() != FormatDirHash(hash) {
+		err = stepError("hash", fmt.Errorf("content hash mismatch: pinned %s, staged %s", dep.ContentHash(), FormatDirHash(hash)))
 		return
 	}
-	staged.Pinned = pin
+	staged.Pinned = pin.WithContentHash(FormatDirHash(hash))
 
 	return
 }
+
+// compareStaged reports whether dir has the same contents as the staged
+// dependency. If dir doesn't exist, an error satisfying os.IsNotExist is
+// returned.
+func compareStaged(dir string, stagedDep StagedDependency) (bool, error) {
+	dstHash, err := CreateDirHash(dir, DependencyFiles(stagedDep.Pinned))
+	if err != nil {
+		return false, err
+	}
+	return FormatDirHash(dstHash) == stagedDep.Pinned.ContentHash(), nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStageGitDependencyShallow(t *testing.T) {
+	repo := makeGitRepo(t, map[string]string{"sub/file1": "one", "other/file2": "two"})
+	defer os.RemoveAll(repo)
+	first := runGit(t, repo, "rev-parse", "HEAD")
+	commitFiles(t, repo, map[string]string{"sub/file1": "changed"})
+	runGit(t, repo, "tag", "v1", first)
+
+	oldArgs, oldCache := cmdLineArgs, gitCache
+	defer func() { cmdLineArgs, gitCache = oldArgs, oldCache }()
+	cmdLineArgs.shallow, cmdLineArgs.sparse, gitCache = true, true, nil
+
+	url := "file://" + filepath.ToSlash(repo)
+	for _, ref := range []string{first, "refs/tags/v1", "v1"} {
+		staged, err := StageDependency(context.Background(), GitDependency{VCS: "git", URL: url, Ref: ref, Dir: "sub"})
+		if err != nil {
+			t.Errorf("StageDependency: %q: %v", ref, err)
+			continue
+		}
+		if pin := staged.Pinned.(GitDependency); pin.Ref != first || (ref == "refs/tags/v1") != (pin.Tag == ref) {
+			t.Errorf("StageDependency: %q: pinned %q from tag %q, expected %q", ref, pin.Ref, pin.Tag, first)
+		}
+		if count := runGit(t, staged.StagingDir, "rev-list", "--count", "HEAD"); count != "1" {
+			t.Errorf("StageDependency: %q: fetched %s commits, expected 1", ref, count)
+		}
+		if _, err := os.Stat(filepath.Join(staged.StagingDir, "other")); !os.IsNotExist(err) {
+			t.Errorf("StageDependency: %q: expected sparse checkout to omit %q", ref, "other")
+		}
+		os.RemoveAll(staged.StagingDir)
+	}
+}
+
+func TestStageGitDependencyFullClone(t *testing.T) {
+	repo := makeGitRepo(t, map[string]string{"file1": "one"})
+	defer os.RemoveAll(repo)
+	sha := commitFiles(t, repo, map[string]string{"file1": "two"})
+
+	oldArgs, oldCache := cmdLineArgs, gitCache
+	defer func() { cmdLineArgs, gitCache = oldArgs, oldCache }()
+	cmdLineArgs.shallow, gitCache = true, nil
+
+	// Branches can move, so are always cloned in full.
+	url := "file://" + filepath.ToSlash(repo)
+	staged, err := StageDependency(context.Background(), GitDependency{VCS: "git", URL: url, Ref: "master", Dir: ""})
+	if err != nil {
+		t.Fatalf("StageDependency: %v", err)
+	}
+	defer os.RemoveAll(staged.StagingDir)
+	if pin := staged.Pinned.(GitDependency).Ref; pin != sha {
+		t.Errorf("StageDependency: pinned %q, expected %q", pin, sha)
+	}
+	if count := runGit(t, staged.StagingDir, "rev-list", "--count", "HEAD"); count != "2" {
+		t.Errorf("StageDependency: fetched %s commits, expected 2", count)
+	}
+}
+
+func TestStageDependenciesContentHash(t *testing.T) {
+	repo := makeGitRepo(t, map[string]string{"file1": "one"})
+	defer os.RemoveAll(repo)
+	sha := runGit(t, repo, "rev-parse", "HEAD")
+
+	oldCache := gitCache
+	defer func() { gitCache = oldCache }()
+	gitCache = nil
+
+	dep := GitDependency{VCS: "git", URL: "file://" + filepath.ToSlash(repo), Ref: sha, Dir: ""}
+	stagedDeps, err := StageDependencies(context.Background(), Manifest{"dep": dep})
+	if err != nil {
+		t.Fatalf("StageDependencies: %v", err)
+	}
+	staged := stagedDeps["dep"]
+	os.RemoveAll(staged.StagingDir)
+	hash := staged.Pinned.ContentHash()
+	if !strings.HasPrefix(hash, "sha256:") {
+		t.Fatalf("StageDependencies: pinned content hash %q, expected a sha256 hash", hash)
+	}
+
+	// Reproducing from the pin succeeds while the contents still match it.
+	stagedDeps, err = StageDependencies(context.Background(), Manifest{"dep": staged.Pinned})
+	if err != nil {
+		t.Errorf("StageDependencies: reproducing from pin: %v", err)
+	} else {
+		os.RemoveAll(stagedDeps["dep"].StagingDir)
+	}
+
+	tampered := staged.Pinned.WithContentHash("sha256:0123")
+	if _, err := StageDependencies(context.Background(), Manifest{"dep": tampered}); err == nil {
+		t.Errorf("StageDependencies: expected error staging with mismatched content hash")
+	}
+}
+
+func TestReusePins(t *testing.T) {
+	project, err := ioutil.TempDir("", "courier_test_project_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(project)
+	inPlace, edited, absent := filepath.Join(project, "a"), filepath.Join(project, "b"), filepath.Join(project, "c")
+	for _, dir := range []string{inPlace, edited} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "file1"), []byte("one"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash, err := CreateDirHash(inPlace, FileFilter{IgnoreDir: ".git"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(edited, "file1"), []byte("edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sha := strings.Repeat("a", 40)
+	pin := GitDependency{VCS: "git", URL: "url", Ref: sha, Dir: "", Tag: "refs/tags/v1", Hash: FormatDirHash(hash)}
+	tests := []struct {
+		dir    string
+		dep    Dependency
+		reused bool
+	}{
+		{inPlace, GitDependency{VCS: "git", URL: "url", Ref: sha, Dir: ""}, true},
+		{inPlace, pin, true},
+		{inPlace, GitDependency{VCS: "git", URL: "url", Ref: "master", Dir: ""}, false},
+		{inPlace, GitDependency{VCS: "git", URL: "url", Ref: "refs/tags/v1", Dir: ""}, true},
+		{inPlace, GitDependency{VCS: "git", URL: "url", Ref: "refs/tags/v2", Dir: ""}, false},
+		{inPlace, GitDependency{VCS: "git", URL: "url", Ref: strings.Repeat("b", 40), Dir: ""}, false},
+		{inPlace, GitDependency{VCS: "git", URL: "other", Ref: sha, Dir: ""}, false},
+		{edited, pin, false},
+		{absent, pin, false},
+	}
+	for _, test := range tests {
+		toStage, reused, err := ReusePins(Manifest{test.dir: test.dep}, Manifest{test.dir: pin})
+		if err != nil {
+			t.Errorf("ReusePins: %q %v: %v", test.dir, test.dep, err)
+			continue
+		}
+		_, staging := toStage[test.dir]
+		if _, ok := reused[test.dir]; ok != test.reused || staging == test.reused {
+			t.Errorf("ReusePins: %q %v: reused %v, expected %v", test.dir, test.dep, ok, test.reused)
+		}
+	}
+}
+
+func TestStageLocalDependency(t *testing.T) {
+	src, err := ioutil.TempDir("", "courier_test_local_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	for _, dir := range []string{"sub", filepath.Join("sub", ".git")} {
+		if err := os.MkdirAll(filepath.Join(src, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(src, dir, "file1"), []byte(dir), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dep := LocalDependency{VCS: "local", Path: src, Dir: "sub"}
+	stagedDeps, err := StageDependencies(context.Background(), Manifest{"dep": dep})
+	if err != nil {
+		t.Fatalf("StageDependencies: %v", err)
+	}
+	staged := stagedDeps["dep"]
+	defer os.RemoveAll(staged.StagingDir)
+	if buf, err := ioutil.ReadFile(filepath.Join(staged.StagingDir, "file1")); err != nil || string(buf) != "sub" {
+		t.Errorf("StageDependency: file1 = %q, %v; expected %q", buf, err, "sub")
+	}
+	if _, err := os.Stat(filepath.Join(staged.StagingDir, ".git")); !os.IsNotExist(err) {
+		t.Errorf("StageDependency: expected .git to be ignored")
+	}
+	pin := staged.Pinned
+	if pin.Revision() == "" || pin.Revision() != pin.ContentHash() {
+		t.Errorf("StageDependency: pinned revision %q, expected the content hash %q", pin.Revision(), pin.ContentHash())
+	}
+
+	// Once the local path has changed, the pin can't be reproduced.
+	if err := ioutil.WriteFile(filepath.Join(src, "sub", "file1"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := StageDependencies(context.Background(), Manifest{"dep": pin}); err == nil {
+		t.Errorf("StageDependencies: expected error reproducing changed local path")
+	}
+}
+
+// blockingBackend stages dependencies only once cancelled, reporting the
+// staging dir it was given.
+type blockingBackend struct {
+	fakeBackend
+	staging chan string
+}
+
+func (b blockingBackend) Stage(ctx context.Context, dep Dependency, stagingDir string) (Dependency, error) {
+	b.staging <- stagingDir
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestStageDependenciesCancelled(t *testing.T) {
+	staging := make(chan string, 2)
+	RegisterBackend("fake", blockingBackend{staging: staging})
+	defer delete(backends, "fake")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() {
+		_, err := StageDependencies(ctx, Manifest{
+			"a": fakeDependency{VCS: "fake", Contents: "a"},
+			"b": fakeDependency{VCS: "fake", Contents: "b"},
+		})
+		errCh <- err
+	}()
+	dir := <-staging
+	cancel()
+	if err := <-errCh; err == nil {
+		t.Fatalf("StageDependencies: expected error when cancelled")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("StageDependencies: staging dir %q not removed: %v", dir, err)
+	}
+}
+
+func TestLoadLocalDependencyMetadataDir(t *testing.T) {
+	src, err := ioutil.TempDir("", "courier_test_local_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	writeFiles(t, src, map[string]string{"file1": "one", ".hg/store": "history"})
+
+	m, err := LoadManifest(context.Background(), []byte(`{"dep": {"vcs": "local", "path": "`+filepath.ToSlash(src)+`"}, "other": {"vcs": "local", "path": "../other", "ignore_dir": "CVS"}}`))
+	if err != nil {
+		t.Fatalf("LoadManifest: %v", err)
+	}
+	if ignore := m["dep"].IgnoreDir(); ignore != ".hg" {
+		t.Errorf("LoadManifest: ignoring %q, expected %q", ignore, ".hg")
+	}
+	if ignore := m["other"].IgnoreDir(); ignore != "CVS" {
+		t.Errorf("LoadManifest: ignoring %q, expected %q", ignore, "CVS")
+	}
+	staged, err := StageDependency(context.Background(), m["dep"])
+	if err != nil {
+		t.Fatalf("StageDependency: %v", err)
+	}
+	defer os.RemoveAll(staged.StagingDir)
+	if _, err := os.Stat(filepath.Join(staged.StagingDir, ".hg")); !os.IsNotExist(err) {
+		t.Errorf("StageDependency: expected .hg to be ignored")
+	}
+
+	if _, err := LoadManifest(context.Background(), []byte(`{"dep": {"vcs": "local", "path": "../other", "ignore_dir": "a/b"}}`)); err == nil {
+		t.Errorf("LoadManifest: expected error for invalid 'ignore_dir'")
+	}
+}
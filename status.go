@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// States reported by DependencyStatus.
+const (
+	StatusOK       = "ok"
+	StatusMissing  = "missing"
+	StatusStale    = "stale"
+	StatusCurrent  = "current"
+	StatusChanged  = "changed"
+	StatusClean    = "clean"
+	StatusModified = "modified"
+	StatusUnknown  = "unknown"
+)
+
+// DependencyStatus describes how a dependency in the primary manifest has
+// drifted from its pin, from upstream, and from what is on disk.
+type DependencyStatus struct {
+	Dir string `json:"dir"`
+
+	// Pin is "ok", "missing" if there is no pin, or "stale" if the pin was made
+	// from a different source to the one in the primary manifest.
+	Pin            string `json:"pin"`
+	PinnedRevision string `json:"pinned_revision,omitempty"`
+
+	// Upstream is "current" if the dependency still resolves to the pinned
+	// revision, "changed" if it doesn't, or "unknown".
+	Upstream         string `json:"upstream"`
+	UpstreamRevision string `json:"upstream_revision,omitempty"`
+
+	// Tree is "clean" if the copied dependency matches its pin, "modified" if
+	// it has been edited, "missing" if it isn't there, or "unknown".
+	Tree string `json:"tree"`
+
+	Errors []string `json:"errors,omitempty"`
+}
+
+func showStatus(ctx context.Context) error {
+	start := time.Now()
+
+	primary, err := readManifest(ctx, cmdLineArgs.primaryManifest)
+	if err != nil {
+		return err
+	}
+	pinned, err := readPinnedManifest(ctx)
+	if os.IsNotExist(err) {
+		LogWarn("Pinned manifest %q does not exist", cmdLineArgs.pinnedManifest)
+		pinned = make(map[string]Dependency)
+	} else if err != nil {
+		return err
+	}
+
+	statuses, err := GetStatus(ctx, primary, pinned)
+	if err != nil {
+		return err
+	}
+
+	if cmdLineArgs.output == "json" {
+		for i, st := range statuses {
+			EmitEvent(Event{Event: "status", Dir: st.Dir, Status: &statuses[i]})
+		}
+		EmitEvent(Event{Event: "finished", DurationMS: msSince(start)})
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "DEPENDENCY\tPIN\tUPSTREAM\tTREE\tPINNED REVISION\tUPSTREAM REVISION\n")
+	for _, st := range statuses {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			st.Dir, st.Pin, st.Upstream, st.Tree, st.PinnedRevision, st.UpstreamRevision)
+	}
+	return w.Flush()
+}
+
+// GetStatus compares each dependency in primary with its pin, with what it
+// resolves to upstream, and with what is on disk. Pinned dependencies without
+// a content hash are staged in order to check for local edits; the tree of
+// any that fails to stage is left unknown, with the error.
+func GetStatus(ctx context.Context, primary, pinned Manifest) ([]DependencyStatus, error) {
+
+	var dirs []string
+	for dir := range primary {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	statuses := make([]DependencyStatus, len(dirs))
+	toStage := make(map[string]Dependency)
+	var wg sync.WaitGroup
+	for i, dir := range dirs {
+		st := &statuses[i]
+		st.Dir, st.Pin, st.Upstream, st.Tree = dir, StatusOK, StatusUnknown, StatusUnknown
+
+		pin, ok := pinned[dir]
+		switch {
+		case !ok:
+			st.Pin = StatusMissing
+		case !PinMatches(primary[dir], pin):
+			st.Pin = StatusStale
+		}
+		if ok {
+			st.PinnedRevision = pin.Revision()
+			toStage[dir] = pin
+		}
+
+		wg.Add(1)
+		go func(dep Dependency) {
+			defer wg.Done()
+			defer jobs.acquire(DependencyHost(dep))()
+			var rev string
+			err := Retry(ctx, fmt.Sprintf("resolving dependency %q upstream", st.Dir), dep.Options(), func(ctx context.Context) error {
+				var err error
+				rev, err = ResolveUpstream(ctx, dep)
+				return err
+			})
+			if err != nil {
+				LogWarn(`Could not resolve dependency %q upstream: %v`, st.Dir, err)
+				st.Errors = append(st.Errors, err.Error())
+				return
+			}
+			st.UpstreamRevision = rev
+			if st.Pin == StatusOK && rev == st.PinnedRevision {
+				st.Upstream = StatusCurrent
+			} else if st.Pin != StatusMissing {
+				st.Upstream = StatusChanged
+			}
+		}(primary[dir])
+	}
+
+	// Pins with a content hash can be compared against without staging them.
+	hashed := make(map[string]StagedDependency)
+	for dir, pin := range toStage {
+		if pin.ContentHash() != "" {
+			hashed[dir] = StagedDependency{Pinned: pin}
+			delete(toStage, dir)
+		}
+	}
+	// A pin that fails to stage only leaves its tree unknown.
+	stagedDeps, failed := StageEachDependency(ctx, toStage)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		removeStaged(stagedDeps)
+		return nil, err
+	}
+	defer removeStaged(stagedDeps)
+	for dir, stagedDep := range hashed {
+		stagedDeps[dir] = stagedDep
+	}
+
+	failedErrs := make(map[string]string)
+	for _, f := range failed {
+		failedErrs[f.Dir] = f.Error
+	}
+	for i := range statuses {
+		st := &statuses[i]
+		if err, ok := failedErrs[st.Dir]; ok {
+			st.Errors = append(st.Errors, err)
+			continue
+		}
+		stagedDep, ok := stagedDeps[st.Dir]
+		if !ok {
+			continue
+		}
+		equal, err := compareStaged(st.Dir, stagedDep)
+		switch {
+		case os.IsNotExist(err):
+			st.Tree = StatusMissing
+		case err != nil:
+			st.Errors = append(st.Errors, err.Error())
+		case equal:
+			st.Tree = StatusClean
+		default:
+			st.Tree = StatusModified
+		}
+	}
+
+	return statuses, nil
+}
+
+// ResolveUpstream returns the revision dep would be pinned to if it were
+// staged now.
+func ResolveUpstream(ctx context.Context, dep Dependency) (string, error) {
+	backend, err := LookupBackend(dep.Kind())
+	if err != nil {
+		return "", err
+	}
+	return backend.Resolve(ctx, dep)
+}
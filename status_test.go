@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGetStatus(t *testing.T) {
+	repo := makeGitRepo(t, map[string]string{"file1": "one"})
+	defer os.RemoveAll(repo)
+	first := runGit(t, repo, "rev-parse", "HEAD")
+	second := commitFiles(t, repo, map[string]string{"file1": "two"})
+	project, err := ioutil.TempDir("", "courier_test_project_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(project)
+
+	oldCache := gitCache
+	defer func() { gitCache = oldCache }()
+	gitCache = nil
+
+	url := "file://" + filepath.ToSlash(repo)
+	clean, modified, missing, unpinned, stale, broken :=
+		filepath.Join(project, "clean"), filepath.Join(project, "modified"), filepath.Join(project, "missing"),
+		filepath.Join(project, "unpinned"), filepath.Join(project, "stale"), filepath.Join(project, "broken")
+	for dir, contents := range map[string]string{clean: "two", modified: "edited", stale: "one"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "file1"), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dep := GitDependency{VCS: "git", URL: url, Ref: "master", Dir: ""}
+	moved := GitDependency{VCS: "git", URL: url, Ref: "master", Dir: "sub"}
+	primary := Manifest{clean: dep, modified: dep, missing: dep, unpinned: dep, stale: moved, broken: dep}
+	pin := GitDependency{VCS: "git", URL: url, Ref: second, Dir: ""}
+	stalePin := GitDependency{VCS: "git", URL: url, Ref: first, Dir: ""}
+	brokenPin := GitDependency{VCS: "git", URL: url, Ref: strings.Repeat("0", 40), Dir: ""}
+	pinned := Manifest{clean: pin, modified: pin, missing: pin, stale: stalePin, broken: brokenPin}
+
+	statuses, err := GetStatus(context.Background(), primary, pinned)
+	if err != nil {
+		t.Fatalf("GetStatus: %v", err)
+	}
+	expected := map[string][3]string{
+		clean:    {StatusOK, StatusCurrent, StatusClean},
+		modified: {StatusOK, StatusCurrent, StatusModified},
+		missing:  {StatusOK, StatusCurrent, StatusMissing},
+		unpinned: {StatusMissing, StatusUnknown, StatusUnknown},
+		stale:    {StatusStale, StatusChanged, StatusClean},
+		broken:   {StatusOK, StatusChanged, StatusUnknown},
+	}
+	if len(statuses) != len(expected) {
+		t.Fatalf("GetStatus: got %d statuses, expected %d", len(statuses), len(expected))
+	}
+	for _, st := range statuses {
+		want := expected[st.Dir]
+		if got := [3]string{st.Pin, st.Upstream, st.Tree}; got != want {
+			t.Errorf("GetStatus: %q: got %v, expected %v", st.Dir, got, want)
+		}
+		if st.Pin != StatusMissing && st.UpstreamRevision != second {
+			t.Errorf("GetStatus: %q: upstream revision %q, expected %q", st.Dir, st.UpstreamRevision, second)
+		}
+		if (st.Dir == broken) != (len(st.Errors) > 0) {
+			t.Errorf("GetStatus: %q: got errors %q", st.Dir, st.Errors)
+		}
+	}
+}
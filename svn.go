@@ -1,37 +1,211 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
-func SVNCheckoutLatest(dir, url string) error {
-	LogDebug(`Performing SVN Checkout Latest from %q to %q`, url, dir)
-	cmd := exec.Command("svn", "checkout", "--non-interactive", url, dir)
-	out, err := cmd.CombinedOutput()
+func init() {
+	RegisterBackend("svn", svnBackend{})
+}
+
+type SVNDependency struct {
+	VCS  string  `json:"vcs"` // XXX it doesn't make sense from a data model point of view to have this field. It's to help converting to JSON.
+	URL  string  `json:"url"`
+	Rev  *string `json:"rev,omitempty"`
+	Dir  string  `json:"dir,omitempty"`
+	Hash string  `json:"hash,omitempty"`
+
+	IgnoreExternals bool `json:"ignore_externals,omitempty"`
+
+	CommonKeys
+}
+
+func (d SVNDependency) Kind() string        { return "svn" }
+func (d SVNDependency) IgnoreDir() string   { return ".svn" }
+func (d SVNDependency) DirToCopy() string   { return d.Dir }
+func (d SVNDependency) ContentHash() string { return d.Hash }
+func (d SVNDependency) Host() string        { return urlHost(d.URL) }
+func (d SVNDependency) Source() string      { return d.URL }
+func (d SVNDependency) Revision() string {
+	if d.Rev == nil {
+		return ""
+	}
+	return *d.Rev
+}
+func (d SVNDependency) Immutable() bool {
+	if d.Rev == nil || *d.Rev == "" {
+		return false
+	}
+	for _, c := range *d.Rev {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+func (d SVNDependency) SameSource(other Dependency) bool {
+	o, ok := other.(SVNDependency)
+	return ok && o.URL == d.URL && o.Dir == d.Dir && o.IgnoreExternals == d.IgnoreExternals
+}
+func (d SVNDependency) WithContentHash(hash string) Dependency {
+	d.Hash = hash
+	return d
+}
+func (d SVNDependency) WithCommon(common CommonKeys) Dependency {
+	d.CommonKeys = common
+	return d
+}
+func (d SVNDependency) WithDir(dir string) Dependency {
+	d.Dir = dir
+	return d
+}
+
+func LoadSVNDependency(depMap map[string]string) (SVNDependency, error) {
+	d := SVNDependency{VCS: "svn"}
+	var ok bool
+	if d.URL, ok = depMap["url"]; !ok {
+		return SVNDependency{}, errors.New("missing required key 'url'")
+	}
+	if _, ok = depMap["rev"]; ok {
+		r := depMap["rev"]
+		d.Rev = &r
+	}
+	d.Dir = depMap["dir"]
+	if err := checkDir(d.Dir); err != nil {
+		return SVNDependency{}, err
+	}
+	d.Hash = depMap["hash"]
+	if ignore, ok := depMap["ignore_externals"]; ok {
+		var err error
+		if d.IgnoreExternals, err = strconv.ParseBool(ignore); err != nil {
+			return SVNDependency{}, fmt.Errorf("invalid value %q for key 'ignore_externals'", ignore)
+		}
+	}
+	delete(depMap, "vcs")
+	delete(depMap, "url")
+	delete(depMap, "rev")
+	delete(depMap, "dir")
+	delete(depMap, "hash")
+	delete(depMap, "ignore_externals")
+	for k, v := range depMap {
+		LogWarn(`Ignoring unknown key value pair %q:%q`, k, v)
+	}
+	return d, nil
+}
+
+type svnBackend struct{}
+
+func (svnBackend) Load(ctx context.Context, depMap map[string]string) (Dependency, error) {
+	return LoadSVNDependency(depMap)
+}
+
+func (svnBackend) Stage(ctx context.Context, dep Dependency, stagingDir string) (Dependency, error) {
+	svnDep := dep.(SVNDependency)
+
+	// Checkout the repo, or with --sparse only the dir we want.
+	url, dir := svnDep.URL, stagingDir
+	if cmdLineArgs.sparse && svnDep.Dir != "" && svnDep.MappedFrom == "" { // Others may share the checkout.
+		url = strings.TrimSuffix(url, "/") + "/" + svnDep.Dir
+		dir = filepath.Join(stagingDir, filepath.FromSlash(svnDep.Dir))
+		if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if svnDep.Rev == nil {
+		err = SVNCheckoutLatest(ctx, dir, url, svnDep.IgnoreExternals)
+	} else {
+		err = SVNCheckoutAtRev(ctx, dir, url, *svnDep.Rev, svnDep.IgnoreExternals)
+	}
 	if err != nil {
-		return fmt.Errorf("%s: %s", err.Error(), trim(out))
+		return nil, err
 	}
-	return nil
+
+	// Get the checked out revision, so we can reproduce the exact version.
+	rev, err := SVNRevision(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	svnDep.Rev = &rev
+	return svnDep, nil
+}
+
+func (svnBackend) Resolve(ctx context.Context, dep Dependency) (string, error) {
+	svnDep := dep.(SVNDependency)
+	if svnDep.Rev != nil {
+		return *svnDep.Rev, nil
+	}
+	return SVNHeadRevision(ctx, svnDep.URL)
 }
 
-func SVNCheckoutAtRev(dir, url, rev string) error {
+func SVNCheckoutLatest(ctx context.Context, dir, url string, ignoreExternals bool) error {
+	LogDebug(`Performing SVN Checkout Latest from %q to %q`, url, dir)
+	return svnCheckout(ctx, dir, url, ignoreExternals)
+}
+
+func SVNCheckoutAtRev(ctx context.Context, dir, url, rev string, ignoreExternals bool) error {
 	LogDebug(`Performing SVN Checkout from %q at %q to %q`, url, rev, dir)
-	cmd := exec.Command("svn", "checkout", "--non-interactive", "--revision", rev, url, dir)
-	out, err := cmd.CombinedOutput()
+	// Peg the revision, so that a url that has since been moved or deleted is
+	// still found, as it was at that revision.
+	err := svnCheckout(ctx, dir, url+"@"+rev, ignoreExternals)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+
+	// The url may only have got its name since, so look for it at the latest
+	// revision and trace it back.
+	LogDebug(`SVN Checkout of %q pegged at %q failed, checking out its history instead: %v`, url, rev, err)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return svnCheckout(ctx, dir, url, ignoreExternals, "--revision", rev)
+}
+
+func svnCheckout(ctx context.Context, dir, url string, ignoreExternals bool, extraArgs ...string) error {
+	args := append([]string{"checkout", "--non-interactive"}, extraArgs...)
+	if ignoreExternals {
+		args = append(args, "--ignore-externals")
+	}
+	cmd := exec.Command("svn", append(args, url, dir)...)
+	out, err := CombinedOutput(ctx, cmd)
 	if err != nil {
-		return fmt.Errorf("%s: %s", err.Error(), trim(out))
+		return commandError("checkout", err, out)
 	}
 	return nil
 }
 
-func SVNVersion(dir string) (string, error) {
-	LogDebug(`Performing SVN version in %q`, dir)
-	cmd := exec.Command("svnversion")
-	cmd.Dir = dir
-	out, err := cmd.CombinedOutput()
+// SVNRevision returns the revision of the working copy in dir. Unlike
+// svnversion, which reports ranges and local modifications, it's always a
+// single revision, also of a working copy of a subpath of a repository.
+func SVNRevision(ctx context.Context, dir string) (string, error) {
+	LogDebug(`Performing SVN Info in %q`, dir)
+	cmd := exec.Command("svn", "info", "--non-interactive", "--show-item", "revision", dir)
+	out, err := CombinedOutput(ctx, cmd)
+	if err != nil {
+		return "", commandError("info", err, out)
+	}
+	rev := trim(out)
+	if _, err := strconv.ParseUint(rev, 10, 64); err != nil {
+		return "", fmt.Errorf("unexpected revision %q of %q", rev, dir)
+	}
+	return rev, nil
+}
+
+// SVNHeadRevision returns the latest revision of the repository at url,
+// without checking it out.
+func SVNHeadRevision(ctx context.Context, url string) (string, error) {
+	LogDebug(`Performing SVN Info of %q`, url)
+	cmd := exec.Command("svn", "info", "--non-interactive", "--show-item", "revision", url)
+	out, err := CombinedOutput(ctx, cmd)
 	if err != nil {
-		return "", fmt.Errorf("%s: %s", err.Error(), trim(out))
+		return "", commandError("info", err, out)
 	}
 	return trim(out), nil
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadSVNDependency(t *testing.T) {
+	m, err := LoadManifest(context.Background(), []byte(`{"lib": {"vcs": "svn", "url": "https://example.com/svn/lib/trunk", "dir": "src", "ignore_externals": true}}`))
+	if err != nil {
+		t.Fatalf("LoadManifest: %v", err)
+	}
+	expected := SVNDependency{VCS: "svn", URL: "https://example.com/svn/lib/trunk", Dir: "src", IgnoreExternals: true}
+	if !reflect.DeepEqual(m["lib"], expected) {
+		t.Errorf("LoadManifest: got %v, expected %v", m["lib"], expected)
+	}
+	// As ever, null is taken as "".
+	if m, err := LoadManifest(context.Background(), []byte(`{"lib": {"vcs": "svn", "url": "https://example.com/svn/lib/trunk", "dir": null}}`)); err != nil || m["lib"].DirToCopy() != "" {
+		t.Errorf("LoadManifest: got %v, %v; expected dir %q", m, err, "")
+	}
+	for _, js := range []string{
+		`{"lib": {"vcs": "svn", "url": "https://example.com/svn/lib", "ignore_externals": "sometimes"}}`,
+		`{"lib": {"vcs": "svn", "url": "https://example.com/svn/lib", "dir": "/src"}}`,
+		`{"lib": {"vcs": "svn", "url": "https://example.com/svn/lib", "dir": "C:\\src"}}`,
+		`{"lib": {"vcs": "svn", "url": "https://example.com/svn/lib", "dir": "src/../.."}}`,
+	} {
+		if _, err := LoadManifest(context.Background(), []byte(js)); err == nil {
+			t.Errorf("LoadManifest: %s: expected error", js)
+		}
+	}
+}
+
+func TestStageSVNDependency(t *testing.T) {
+	for _, tool := range []string{"svn", "svnadmin"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found on PATH", tool)
+		}
+	}
+	tmp, err := ioutil.TempDir("", "courier_test_repo_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	run := func(name string, args ...string) {
+		out, err := exec.Command(name, args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s %v: %v: %s", name, args, err, out)
+		}
+	}
+	repo, src := filepath.Join(tmp, "repo"), filepath.Join(tmp, "src")
+	run("svnadmin", "create", repo)
+	writeFiles(t, src, map[string]string{"sub/file1": "one", "other/file2": "two"})
+	url := "file://" + filepath.ToSlash(repo)
+	run("svn", "import", "--non-interactive", "-m", "import", src, url+"/trunk")
+	run("svn", "mkdir", "--non-interactive", "-m", "elsewhere", url+"/branches")
+
+	oldArgs := cmdLineArgs
+	defer func() { cmdLineArgs = oldArgs }()
+	for _, sparse := range []bool{false, true} {
+		cmdLineArgs.sparse = sparse
+		staged, err := StageDependency(context.Background(), SVNDependency{VCS: "svn", URL: url + "/trunk", Dir: "sub", IgnoreExternals: true})
+		if err != nil {
+			t.Fatalf("StageDependency: sparse %v: %v", sparse, err)
+		}
+		defer os.RemoveAll(staged.StagingDir)
+		if pin := staged.Pinned.Revision(); pin != "2" {
+			t.Errorf("StageDependency: sparse %v: pinned %q, expected %q", sparse, pin, "2")
+		}
+		if buf, err := ioutil.ReadFile(filepath.Join(staged.StagingDir, "sub", "file1")); err != nil || string(buf) != "one" {
+			t.Errorf("StageDependency: sparse %v: sub/file1 = %q, %v; expected %q", sparse, buf, err, "one")
+		}
+	}
+
+	// Revisions are found both once the url is gone, and before it was
+	// named so.
+	run("svn", "move", "--non-interactive", "-m", "move", url+"/trunk", url+"/moved")
+	for _, moved := range []string{url + "/trunk", url + "/moved"} {
+		rev := "2"
+		staged, err := StageDependency(context.Background(), SVNDependency{VCS: "svn", URL: moved, Rev: &rev, Dir: "sub"})
+		if err != nil {
+			t.Fatalf("StageDependency: %q at revision %s: %v", moved, rev, err)
+		}
+		os.RemoveAll(staged.StagingDir)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines around each hunk.
+const diffContext = 3
+
+// maxDiffLines is the number of lines of a file, before and after, above which
+// it's only noted as differing, as diffing it could take too long.
+const maxDiffLines = 20000
+
+// DiffPatch returns a unified diff, as applied with `patch -p1` from oldDir,
+// of the added, removed and modified files in d. Binary and very long files
+// are only noted as differing, and changes of mode are left out.
+func DiffPatch(oldDir, newDir string, d DirDiff) (string, error) {
+	var paths []string
+	paths = append(paths, d.Added...)
+	paths = append(paths, d.Removed...)
+	paths = append(paths, d.Modified...)
+	sort.Strings(paths)
+
+	var buf bytes.Buffer
+	for _, p := range paths {
+		oldContents, oldName, err := readDiffFile(oldDir, p, "a/")
+		if err != nil {
+			return "", err
+		}
+		newContents, newName, err := readDiffFile(newDir, p, "b/")
+		if err != nil {
+			return "", err
+		}
+		if isBinary(oldContents) || isBinary(newContents) {
+			fmt.Fprintf(&buf, "Binary files %s and %s differ\n", oldName, newName)
+			continue
+		}
+		if bytes.Count(oldContents, []byte("\n"))+bytes.Count(newContents, []byte("\n")) > maxDiffLines {
+			fmt.Fprintf(&buf, "Files %s and %s differ\n", oldName, newName)
+			continue
+		}
+		buf.WriteString(UnifiedDiff(oldName, newName, oldContents, newContents))
+	}
+	return buf.String(), nil
+}
+
+// readDiffFile returns the contents of file p in dir and its name in a patch,
+// or no contents and /dev/null if it doesn't exist.
+func readDiffFile(dir, p, prefix string) ([]byte, string, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(p)))
+	if os.IsNotExist(err) {
+		return nil, "/dev/null", nil
+	} else if err != nil {
+		return nil, "", err
+	}
+	return contents, prefix + p, nil
+}
+
+// isBinary reports whether contents look like those of a binary file, as Git
+// and diff judge it: by a NUL byte near the start.
+func isBinary(contents []byte) bool {
+	if len(contents) > 8000 {
+		contents = contents[:8000]
+	}
+	return bytes.IndexByte(contents, 0) >= 0
+}
+
+// UnifiedDiff returns the unified diff of the lines of oldContents and
+// newContents, or "" if they're the same.
+func UnifiedDiff(oldName, newName string, oldContents, newContents []byte) string {
+	ops := diffLines(splitLines(oldContents), splitLines(newContents))
+
+	// Number each op by the old and new lines before it.
+	oldLine, newLine := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	var changes []int
+	for i, op := range ops {
+		oldLine[i+1], newLine[i+1] = oldLine[i], newLine[i]
+		if op.kind != '+' {
+			oldLine[i+1]++
+		}
+		if op.kind != '-' {
+			newLine[i+1]++
+		}
+		if op.kind != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", oldName, newName)
+	for len(changes) > 0 {
+		// Take the changes close enough to share context into one hunk.
+		last := 0
+		for last+1 < len(changes) && changes[last+1]-changes[last] <= 2*diffContext+1 {
+			last++
+		}
+		start, end := changes[0]-diffContext, changes[last]+diffContext+1
+		if start < 0 {
+			start = 0
+		}
+		if end > len(ops) {
+			end = len(ops)
+		}
+		changes = changes[last+1:]
+
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n",
+			hunkRange(oldLine[start], oldLine[end]-oldLine[start]),
+			hunkRange(newLine[start], newLine[end]-newLine[start]))
+		for _, op := range ops[start:end] {
+			buf.WriteByte(op.kind)
+			buf.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+	return buf.String()
+}
+
+// hunkRange formats the lines of a hunk that follow the first skipped lines.
+func hunkRange(skipped, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", skipped)
+	case 1:
+		return fmt.Sprintf("%d", skipped+1)
+	}
+	return fmt.Sprintf("%d,%d", skipped+1, count)
+}
+
+// splitLines splits contents after each newline.
+func splitLines(contents []byte) []string {
+	var lines []string
+	for len(contents) > 0 {
+		i := bytes.IndexByte(contents, '\n') + 1
+		if i == 0 {
+			i = len(contents)
+		}
+		lines = append(lines, string(contents[:i]))
+		contents = contents[i:]
+	}
+	return lines
+}
+
+// diffOp is a line kept (' '), removed ('-') or added ('+').
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diffLines returns the shortest edit script turning a into b, using the
+// linear space version of Myers' algorithm.
+func diffLines(a, b []string) []diffOp {
+	var ops []diffOp
+	diffRange(a, b, &ops)
+	return ops
+}
+
+// diffRange appends the edit script turning a into b to ops.
+func diffRange(a, b []string, ops *[]diffOp) {
+
+	// Keep the lines that are the same at the start and the end.
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for _, line := range a[:prefix] {
+		*ops = append(*ops, diffOp{' ', line})
+	}
+	a, b = a[prefix:], b[prefix:]
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	defer func(same []string) {
+		for _, line := range same {
+			*ops = append(*ops, diffOp{' ', line})
+		}
+	}(a[len(a)-suffix:])
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+
+	// Split what's left where the shortest edit script crosses its middle.
+	if len(a) > 0 && len(b) > 0 {
+		if x, y, ok := middleSnake(a, b); ok {
+			diffRange(a[:x], b[:y], ops)
+			diffRange(a[x:], b[y:], ops)
+			return
+		}
+	}
+	for _, line := range a {
+		*ops = append(*ops, diffOp{'-', line})
+	}
+	for _, line := range b {
+		*ops = append(*ops, diffOp{'+', line})
+	}
+}
+
+// middleSnake searches for the shortest edit script turning a into b from both
+// ends at once, and returns where the two searches meet, or false if a and b
+// have no lines in common.
+func middleSnake(a, b []string) (int, int, bool) {
+	n, m := len(a), len(b)
+	max := (n + m + 1) / 2
+	// The furthest x reached, forwards from the start and backwards from the
+	// end, on each diagonal k, at vf[max+k] and vb[max+k], or -1.
+	vf, vb := make([]int, 2*max+2), make([]int, 2*max+2)
+	for i := range vf {
+		vf[i], vb[i] = -1, -1
+	}
+	vf[max+1], vb[max+1] = 0, 0
+	delta := n - m
+	odd := delta%2 != 0 // Whether the forward search is the one to meet.
+	// Diagonals that ran off the edges needn't be searched further.
+	fStart, fEnd, bStart, bEnd := 0, 0, 0, 0
+	for d := 0; d < max; d++ {
+		for k := -d + fStart; k <= d-fEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && vf[max+k-1] < vf[max+k+1]) {
+				x = vf[max+k+1]
+			} else {
+				x = vf[max+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			vf[max+k] = x
+			switch {
+			case x > n:
+				fEnd += 2
+			case y > m:
+				fStart += 2
+			case odd:
+				if i := max + delta - k; i >= 0 && i < len(vb) && vb[i] != -1 && x >= n-vb[i] {
+					return x, y, true
+				}
+			}
+		}
+		for k := -d + bStart; k <= d-bEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && vb[max+k-1] < vb[max+k+1]) {
+				x = vb[max+k+1]
+			} else {
+				x = vb[max+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-1-x] == b[m-1-y] {
+				x++
+				y++
+			}
+			vb[max+k] = x
+			switch {
+			case x > n:
+				bEnd += 2
+			case y > m:
+				bStart += 2
+			case !odd:
+				if i := max + delta - k; i >= 0 && i < len(vf) && vf[i] != -1 {
+					fx := vf[i]
+					if fx >= n-x {
+						return fx, fx - (i - max), true
+					}
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
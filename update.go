@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+func updateDependencies(ctx context.Context, patterns []string) error {
+	start := time.Now()
+
+	if len(patterns) == 0 {
+		return errors.New("update requires the dependencies to update")
+	}
+
+	primary, err := readManifest(ctx, cmdLineArgs.primaryManifest)
+	if err != nil {
+		return err
+	}
+	pinned, err := readPinnedManifest(ctx)
+	if os.IsNotExist(err) {
+		LogWarn("Pinned manifest %q does not exist", cmdLineArgs.pinnedManifest)
+		pinned = make(map[string]Dependency)
+	} else if err != nil {
+		return err
+	}
+
+	selected, err := SelectDependencies(primary, patterns)
+	if err != nil {
+		return err
+	}
+
+	// Dependencies mapped from the same entry are pinned at the same revision.
+	selected = AddMappedSiblings(primary, selected)
+
+	// Stage the dependencies.
+	stagedDeps, err := StageDependencies(ctx, selected)
+	if err != nil {
+		return err
+	}
+
+	// Clean up the staged dependencies when we return.
+	defer removeStaged(stagedDeps)
+
+	// Show what would change instead of changing it.
+	if cmdLineArgs.dryRun {
+		return showChanges(stagedDeps, pinned)
+	}
+
+	// Copy the dependencies.
+	if err := copyDependencies(ctx, stagedDeps); err != nil {
+		return err
+	}
+
+	// Save the pinned manifest to file.
+	if err := savePinnedManifest(UpdatePins(primary, pinned, stagedDeps)); err != nil {
+		return err
+	}
+
+	LogInfo("Finished!")
+	EmitEvent(Event{Event: "finished", DurationMS: msSince(start)})
+
+	return nil
+}
+
+// SelectDependencies returns the dependencies in m whose dirs, or the keys of
+// the entries they were mapped from, match any of patterns, which may be dirs
+// or globs as accepted by path.Match. Every pattern must match at least one
+// dependency.
+func SelectDependencies(m Manifest, patterns []string) (Manifest, error) {
+	var selected Manifest = make(map[string]Dependency)
+	for _, pattern := range patterns {
+		var found bool
+		for dir, dep := range m {
+			for _, name := range []string{dir, dep.Sharing().MappedFrom} {
+				if name == "" {
+					continue
+				}
+				matched, err := path.Match(pattern, name)
+				if err != nil {
+					return nil, fmt.Errorf("bad pattern %q: %v", pattern, err)
+				}
+				if matched || path.Clean(pattern) == path.Clean(name) {
+					selected[dir] = dep
+					found = true
+				}
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no dependency matches %q", pattern)
+		}
+	}
+	return selected, nil
+}
+
+// UpdatePins returns pinned with the pins of stagedDeps replaced, keeping the
+// existing pins of every other dependency, even those no longer in primary.
+func UpdatePins(primary, pinned Manifest, stagedDeps map[string]StagedDependency) Manifest {
+	var updated Manifest = make(map[string]Dependency)
+	for dir, pin := range pinned {
+		updated[dir] = pin
+	}
+	for dir, stagedDep := range stagedDeps {
+		updated[dir] = stagedDep.Pinned
+	}
+	for dir, dep := range primary {
+		if _, ok := stagedDeps[dir]; ok {
+			continue
+		} else if pin, ok := pinned[dir]; !ok {
+			LogWarn(`Dependency %q is not pinned, update it to pin it`, dir)
+		} else if !PinMatches(dep, pin) {
+			LogWarn(`Pin of dependency %q is stale, update it to re-pin it`, dir)
+		}
+	}
+	for dir := range pinned {
+		if _, ok := primary[dir]; !ok {
+			LogWarn(`Pinned dependency %q is no longer in %q`, dir, cmdLineArgs.primaryManifest)
+		}
+	}
+	return updated
+}
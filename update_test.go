@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSelectDependencies(t *testing.T) {
+	dep := GitDependency{VCS: "git"}
+	mapped := GitDependency{VCS: "git", CommonKeys: CommonKeys{SharedCheckout: SharedCheckout{MappedFrom: "vendor/multi"}}}
+	m := Manifest{"lib/a": dep, "lib/b": dep, "tools/c": dep, "vendor/multi/x": mapped, "vendor/multi/y": mapped}
+	tests := []struct {
+		patterns []string
+		expected []string
+	}{
+		{[]string{"lib/a"}, []string{"lib/a"}},
+		{[]string{"lib/a/"}, []string{"lib/a"}},
+		{[]string{"lib/*"}, []string{"lib/a", "lib/b"}},
+		{[]string{"tools/c", "lib/b"}, []string{"lib/b", "tools/c"}},
+		{[]string{"vendor/multi"}, []string{"vendor/multi/x", "vendor/multi/y"}},
+		{[]string{"vendor/multi/x"}, []string{"vendor/multi/x"}},
+		{[]string{"vendor/*"}, []string{"vendor/multi/x", "vendor/multi/y"}},
+	}
+	for _, test := range tests {
+		selected, err := SelectDependencies(m, test.patterns)
+		if err != nil {
+			t.Errorf("SelectDependencies: %v: %v", test.patterns, err)
+			continue
+		}
+		var dirs []string
+		for dir := range selected {
+			dirs = append(dirs, dir)
+		}
+		sort.Strings(dirs)
+		if !reflect.DeepEqual(dirs, test.expected) {
+			t.Errorf("SelectDependencies: %v: got %v, expected %v", test.patterns, dirs, test.expected)
+		}
+	}
+
+	for _, patterns := range [][]string{{"lib/c"}, {"lib/a", "other/*"}, {"lib/["}} {
+		if _, err := SelectDependencies(m, patterns); err == nil {
+			t.Errorf("SelectDependencies: %v: expected error", patterns)
+		}
+	}
+}
+
+func TestUpdatePins(t *testing.T) {
+	primary := Manifest{
+		"a": GitDependency{VCS: "git", URL: "a", Ref: "master"},
+		"b": GitDependency{VCS: "git", URL: "b", Ref: "master"},
+		"c": GitDependency{VCS: "git", URL: "c", Ref: "master"},
+	}
+	pinned := Manifest{
+		"a":       GitDependency{VCS: "git", URL: "a", Ref: "old-a"},
+		"b":       GitDependency{VCS: "git", URL: "b", Ref: "old-b"},
+		"removed": GitDependency{VCS: "git", URL: "removed", Ref: "old"},
+	}
+	staged := map[string]StagedDependency{
+		"a": {Pinned: GitDependency{VCS: "git", URL: "a", Ref: "new-a"}},
+	}
+	// Only the staged pins change.
+	expected := Manifest{
+		"a":       GitDependency{VCS: "git", URL: "a", Ref: "new-a"},
+		"b":       GitDependency{VCS: "git", URL: "b", Ref: "old-b"},
+		"removed": GitDependency{VCS: "git", URL: "removed", Ref: "old"},
+	}
+	if updated := UpdatePins(primary, pinned, staged); !reflect.DeepEqual(updated, expected) {
+		t.Errorf("UpdatePins: got %v, expected %v", updated, expected)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Mismatch describes a pinned dependency whose copy differs from its pin.
+type Mismatch struct {
+	Dir  string `json:"dir"`
+	Tree string `json:"tree"` // "modified" or "missing".
+}
+
+func verifyDependencies(ctx context.Context) error {
+	start := time.Now()
+
+	pinned, err := readPinnedManifest(ctx)
+	if err != nil {
+		return err
+	}
+
+	mismatches, err := VerifyDependencies(ctx, pinned)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range mismatches {
+		LogWarn(`Dependency %q is %s`, m.Dir, m.Tree)
+		EmitEvent(Event{Event: "mismatch", Dir: m.Dir, Reason: m.Tree})
+	}
+
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%d of %d dependencies differ from %q", len(mismatches), len(pinned), cmdLineArgs.pinnedManifest)
+	}
+	LogInfo("All dependencies match %q", cmdLineArgs.pinnedManifest)
+	EmitEvent(Event{Event: "finished", DurationMS: msSince(start)})
+	return nil
+}
+
+// VerifyDependencies stages each pinned dependency and compares it with what
+// is on disk, without copying anything. It returns the dependencies that
+// differ, sorted by dir.
+func VerifyDependencies(ctx context.Context, pinned Manifest) ([]Mismatch, error) {
+
+	stagedDeps, err := StageDependencies(ctx, pinned)
+	if err != nil {
+		return nil, err
+	}
+	defer removeStaged(stagedDeps)
+
+	var dirs []string
+	for dir := range stagedDeps {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	mismatches := []Mismatch{}
+	for _, dir := range dirs {
+		equal, err := compareStaged(dir, stagedDeps[dir])
+		switch {
+		case os.IsNotExist(err):
+			mismatches = append(mismatches, Mismatch{dir, StatusMissing})
+		case err != nil:
+			return nil, err
+		case !equal:
+			mismatches = append(mismatches, Mismatch{dir, StatusModified})
+		}
+	}
+	return mismatches, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestVerifyDependencies(t *testing.T) {
+	repo := makeGitRepo(t, map[string]string{"file1": "one"})
+	defer os.RemoveAll(repo)
+	sha := runGit(t, repo, "rev-parse", "HEAD")
+	project, err := ioutil.TempDir("", "courier_test_project_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(project)
+
+	oldCache := gitCache
+	defer func() { gitCache = oldCache }()
+	gitCache = nil
+
+	clean, modified, missing := filepath.Join(project, "a"), filepath.Join(project, "b"), filepath.Join(project, "c")
+	for dir, contents := range map[string]string{clean: "one", modified: "edited"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "file1"), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pin := GitDependency{VCS: "git", URL: "file://" + filepath.ToSlash(repo), Ref: sha, Dir: ""}
+	mismatches, err := VerifyDependencies(context.Background(), Manifest{clean: pin, modified: pin, missing: pin})
+	if err != nil {
+		t.Fatalf("VerifyDependencies: %v", err)
+	}
+	expected := []Mismatch{{modified, StatusModified}, {missing, StatusMissing}}
+	if !reflect.DeepEqual(mismatches, expected) {
+		t.Errorf("VerifyDependencies: got %v, expected %v", mismatches, expected)
+	}
+}